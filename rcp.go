@@ -2,21 +2,78 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
 	"io"
+	"maps"
+	"math"
+	"math/big"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 const defaultMaxBytes = 100000
 
+// The streams, environment and clock rcp works with. run points the streams
+// and environment at its arguments; they live at package level so helpers
+// needn't pass them along. Tests may replace now.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+	tty    io.Writer // /dev/tty, or nil if there is none; OSC52 reads need it to be an io.Reader too
+	getenv = os.Getenv
+	now    = time.Now // stamps (-ts, -record), -cooldown and the status duration
+)
+
+// base64Limit is the -max-base64-bytes value when it, not RCOPY_MAX_BYTES,
+// sets the size limit, so the too-large tip can name the right knob.
+var base64Limit int
+
+// exitCode is the status run returns when something calls exit.
+type exitCode int
+
+// exit stops run with status code. Only use it on run's goroutine.
+func exit(code int) {
+	panic(exitCode(code))
+}
+
+// homeDir is os.UserHomeDir, reading HOME through getenv.
+func homeDir() (string, error) {
+	if h := getenv("HOME"); h != "" {
+		return h, nil
+	}
+	return "", errors.New("$HOME is not defined")
+}
+
 func usage() {
-	fmt.Fprintln(os.Stderr, `rcp - copy text to clipboard via OSC52 (works over SSH/tmux when supported)
+	fmt.Fprint(stderr, `rcp - copy text to clipboard via OSC52 (works over SSH/tmux when supported)
 
 Usage:
   rcp <file>         Copy a file's contents
@@ -26,20 +83,225 @@ Usage:
 Extras:
   rcp -c <file>      Copy: "cat <file>" + newline + file contents
   rcp -e "command"   Copy: "<command>" + newline + command output
+  -e-sep STRING      With -e, put STRING between command and output (default "\n")
+  -e-dry             With -e, copy just the command text; don't run it
+  -clean-env         With -e, give the command only PATH, HOME, USER, LOGNAME,
+                     SHELL, TERM, LANG, LC_ALL, TZ and TMPDIR
+  -keep-env KEY      Also pass KEY with -clean-env (repeatable)
+  -e-stream          With -e, re-copy the output while the command runs: after
+                     each pause, and at least every -stream-interval
+  -stream-interval D How often -e-stream re-copies at most (default 1s)
+  -retries N         With -e, re-run a failing command up to N more times;
+                     only the last attempt's output is copied
+  -retry-delay D     Wait between retries (default 1s)
+  -cooldown D        Refuse to copy if the last -cooldown copy was less than D
+                     ago (guards against scripts calling rcp in a tight loop)
+  -force             Copy anyway, within -cooldown
+  -max-runtime D     Bound the whole run (reading, -e, sending); when D passes,
+                     kill the -e command and exit 124
+  -inputs LIST       Copy: the files in LIST (comma-separated, LABEL=PATH to label
+                     one), concatenated in order; /dev/fd/N works too
+  -headers           With -inputs, put a "==> PATH <==" banner before every file
+  -headers-size      Add each regular file's size to its banner
+  -map LIST          Send each file to its own selection: FILE:SEL,... where SEL
+                     is c (clipboard), p (primary), s, q or 0-7; copied as-is
+  -swap-selection F:T
+                     Copy selection F into selection T as-is, e.g. p:c puts
+                     PRIMARY on the clipboard (selections as for -map)
+  rcp -promote       Copy the local PRIMARY selection to the local CLIPBOARD with
+                     wl-clipboard, xclip or xsel (no OSC52; for WM keybindings)
+  rcp -calc EXPR     Copy: the value of EXPR (numbers, + - * / %, parentheses),
+                     e.g. -calc '(1024*3)/4'; no shell involved
+  rcp -bridge        Copy: the local clipboard (xclip/wl-paste/xsel/pbpaste)
+
+Headers:
+  -host              Start the copy with a "# host: NAME" line
+  -host-user         With -host, add the current user: "# host: NAME user: USER"
+
+Checks:
+  -decompress        If the input is gzip-compressed, copy it decompressed (the
+                     size limit applies to the result); otherwise copy as usual
+  -jq PATH           Parse the input as JSON and copy the value at PATH, a dotted
+                     path such as .data.token or .items.0.name (not full jq);
+                     strings are copied without quotes
+  -base FROM:TO      Read the input as a number in base FROM and copy it in base
+                     TO, e.g. 16:10; bases 2, 8, 10, 16; 0x/0o/0b optional
+  -filter CMD        Pipe the content (after the transforms) into CMD, run with
+                     bash -c, and copy what it prints; refuse if it fails
+  -validate FORMAT   Refuse to copy unless the content parses as FORMAT: json or
+                     yaml
+  -pretty            With -validate json, copy the content pretty-printed
+
+Transforms (applied in this order, before -validate):
+  -interp            Replace ${NAME} with the value given by -var NAME=VALUE
+                     (repeatable); "$$" becomes "$", unknown names stay as-is
+  -interp-strict     With -interp, refuse to copy if a ${NAME} has no -var
+  -urls              Copy only the http, https and ftp URLs in the content, one
+                     per line, in order of first appearance
+  -urls-unique       With -urls, drop repeats (default true; -urls-unique=false
+                     keeps them)
+  -mask RE           Replace each match of RE with "*"s of the same length,
+                     keeping the first and last 2 characters of matches of 8
+                     or more (repeatable)
+  -strip-prompt      Remove leading shell prompts ("$ ", "user@host:~$ ", ...)
+  -prompt-regex RE   Prompt pattern for -strip-prompt (matched at line start)
+  -strip-comments S  Drop comments of style S: hash (#), slash (//), semicolon (;)
+  -join-continuations
+                     Join lines ending in "\" with the next one, so a command
+                     pastes as one line (an escaped "\\" doesn't count)
+  -unwrap            Join lines starting with a space or tab onto the line before
+                     (wrapped log entries, stack traces)
+  -unwrap-space      With -unwrap, join with one space instead of keeping the
+                     indentation
+  -rtrim-lines       Remove trailing spaces and tabs from every line
+  -strip-quotes      Remove one layer of matching '...' or "..." quotes around
+                     the content
+  -per-line          With -strip-quotes, unquote each line on its own
+  -collapse-blank    Squeeze runs of blank lines down to one
+  -tidy              Clean up code for sharing: -rtrim-lines, then
+                     -collapse-blank, then remove the indentation all lines
+                     share, then end with exactly one newline
+  -tilde             Replace your home directory with ~ (whole path parts only)
+  -tilde-env         With -tilde, also turn $HOME and ${HOME} into ~
+  -sort              Sort lines
+  -sort-numeric      Sort lines by leading number (like sort -n)
+  -reverse           Reverse the sort order (implies -sort)
+  -uniq              Drop adjacent duplicate lines (after sorting, like uniq)
+  -escape LANG       Wrap the content as a string literal: go, json, shell, python
+  -plain             Copy byte-for-byte: ignore all of the above, -ts, -pretty
+                     and -data-uri, however they were set
+
+Timestamps:
+  -ts                Prefix each line of content with the time it was read
+  -ts-format LAYOUT  Go time layout for -ts (default "2006-01-02 15:04:05")
+
+Filtering (stdin only, line by line as it is read):
+  -grep RE           Copy only the lines matching RE (Go regexp syntax)
+  -grep-v            With -grep, copy the lines that don't match instead
+
+Streaming:
+  -follow            Keep reading stdin; after each pause, re-copy the last
+                     RCOPY_MAX_BYTES of it (starting at a line)
+  -quiet-interval D  Pause that triggers a -follow copy (default 1s)
+
+Diagnostics:
+  -detect            Report line endings, UTF-8 validity, BOM, size and whether
+                     the input looks binary, without copying (any size)
+
+Sharing:
+  -paste-service URL POST the content to a paste service and copy the link it
+                     returns instead
+  -paste-format F    Request body: raw (default), form or json
+  -paste-field NAME  Form/JSON field holding the content (default "content")
+
+Safety:
+  -root DIR          Refuse files that resolve (symlinks, ..) outside DIR; exit 3
+
+Large files:
+  rcp -resume <file> Copy the next limit-sized piece; run again for the rest
+
+Emission:
+  -progress          While reading a file, show a progress bar on /dev/tty (not
+                     stdout); cleared when done. Off with -q
+  -pass              Also write the input to stdout unchanged (tee); the OSC52
+                     sequence goes to /dev/tty instead
+  -both-tmux         Inside tmux, also load tmux's paste buffer (prefix-]) and
+                     send the OSC52 sequence through tmux passthrough
+  -chunk-resume      On kitty, send in chunks framed so that an interrupted send
+                     (Ctrl-C, write error) clears the clipboard instead of
+                     leaving part of the content; chunks are -max-seq-bytes
+                     or 4 KiB
+  -max-base64-bytes N
+                     Also cap the base64-encoded content at N bytes (raw limit
+                     N/4*3); the smaller of this and RCOPY_MAX_BYTES applies
+  -max-seq-bytes N   Split sequences longer than N bytes (0: per-terminal default)
+  -record PATH       Also append every emitted sequence to PATH, each after a
+                     "# rcp <time>, <n> bytes" line; replay with cat
+  -raw               With -record, write only the sequences
+  -auto-max          Probe OSC52 on the terminal (write + read back) and, if it
+                     works, use the terminal's known size limit
+
+Clipboard:
+  rcp -peek          Show the clipboard's content on stderr (first 2000 bytes)
+                     without changing it
+  -diff-clipboard    Only copy if the clipboard holds something different
+  -on-empty P        When there is nothing to copy: refuse (default; exit 1),
+                     clear (wipe the clipboard) or allow (send it empty)
+  -verify            After copying, read the clipboard back over OSC52 and exit 1
+                     unless it matches
+  -v                 Verbose: with -diff-clipboard, show the line diff
+  -q                 Never print the "Sent ..." status line
+  -status            Print it even when stderr isn't a terminal (by default it
+                     only shows interactively); errors always show
+  -status-format T   Go template for the "Sent ..." line; fields .Bytes, .Chunks,
+                     .Mode, .Selection, .Wrap, .Duration, e.g.
+                     'copied {{.Bytes}}B in {{.Duration}}'
+  -notify            After copying, show a desktop notification with the byte
+                     count and source (notify-send, osascript or a toast)
+
+Profiles:
+  -profile NAME      Apply the flags under [NAME] in $XDG_CONFIG_HOME/rcp/config
+                     first; flags on the command line override them
+
+Images:
+  rcp -img <file>    Show an image inline (iTerm2/kitty) and copy its bytes
+  -data-uri          Copy the content as data:<mime>;base64,... (up to 32 KiB)
 
 Notes:
   - If you run rcp with no args on a normal terminal (no pipe), it shows this help.
   - -c only makes sense with a filename (stdin has no name).
   - -e runs the command using: bash -c "<command>"
+  - -filter's output is held to the size limit too, and its stderr shows as-is.
+  - A labeled -inputs entry is preceded by a "==> LABEL <==" line.
+  - The -host header is added after transforms and -validate, and counts toward
+    the size limit.
+  - -e-sep understands backslash escapes, e.g. -e-sep '\n---\n'.
+  - -validate reports the line and column of the first parse error. The YAML
+    check covers structure (indentation, quotes, brackets, duplicate keys) but
+    not complex (?) keys.
+  - -strip-comments removes whole comment lines and trailing comments. A trailing
+    marker only counts at the start of a line or after whitespace, and not inside
+    '...' or "..." (so "a#b" and http://x survive).
+  - -ts stamps content lines only (not the -c/-e banner line). Transforms run
+    afterwards and see the stamped lines.
+  - -resume cuts pieces at the last newline when it can and remembers the
+    offset in $XDG_STATE_HOME/rcp/resume.json. It starts over if the file's size
+    or modification time changed. A piece leaves room for the -host header;
+    -ts can't be used with it, since stamps would push a piece over the limit.
+  - -follow holds about RCOPY_MAX_BYTES in memory, sends at most one sequence per
+    pause, and runs until stdin closes. Transforms apply to each tail sent.
+  - -e-stream sends a full sequence on every update, which can flood a slow
+    terminal or link; raise -stream-interval if so. If the output outgrows the
+    limit, updates carry its latest part (from a line start) instead of failing.
+  - A profile section lists flags separated by whitespace, over any number of
+    lines; there is no quoting, and '#' starts a comment. A repeatable flag on
+    the command line replaces the profile's values for it, and one that
+    conflicts with a profile flag (-status against -q) drops that flag.
+  - -auto-max writes a short probe to the clipboard and puts the old content
+    back. It is skipped when RCOPY_MAX_BYTES is set; if the probe fails the
+    default limit is kept.
+  - Only GNU screen has a chunked form (the sequence is split across DCS
+    passthrough strings, which screen reassembles); it is used automatically
+    past 768 bytes there. Elsewhere a sequence over -max-seq-bytes is sent whole
+    with a warning.
+  - -bridge pushes the local CLIPBOARD (or PRIMARY with -bridge-from primary)
+    out as OSC52, e.g. to the terminal of a nested SSH session.
+  - The clipboard is read with pbpaste, wl-paste, xclip or xsel when a local
+    display is available, otherwise by asking the terminal via OSC52 (many
+    terminals disable OSC52 reads or prompt first).
+  - -img refuses anything that doesn't sniff as an image. The clipboard gets the
+    raw image bytes (OSC52 base64-encodes them on the wire); whether a paste
+    yields an image or text depends on the local terminal and OS.
 
 Env:
   RCOPY_MAX_BYTES=100000
+  RCOPY_PASTE_AUTH="Header: value"   extra header sent with -paste-service
 `)
-	os.Exit(2)
+	exit(2)
 }
 
 func getenvInt(name string, def int) int {
-	v := os.Getenv(name)
+	v := getenv(name)
 	if v == "" {
 		return def
 	}
@@ -50,8 +312,22 @@ func getenvInt(name string, def int) int {
 	return n
 }
 
+// isTerminal reports whether w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func isStdinPiped() bool {
-	fi, err := os.Stdin.Stat()
+	f, ok := stdin.(*os.File)
+	if !ok {
+		return stdin != nil
+	}
+	fi, err := f.Stat()
 	if err != nil {
 		return false
 	}
@@ -89,14 +365,165 @@ func (l *limitedBuffer) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func copyLimited(dst *limitedBuffer, r io.Reader) error {
+// timestampWriter prefixes every line written through it with the time the
+// line started arriving.
+type timestampWriter struct {
+	w       io.Writer
+	layout  string
+	midLine bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if !t.midLine {
+			if _, err := io.WriteString(t.w, now().Format(t.layout)+" "); err != nil {
+				return n, err
+			}
+			t.midLine = true
+		}
+		seg := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			seg = p[:i+1]
+			t.midLine = false
+		}
+		if _, err := t.w.Write(seg); err != nil {
+			return n, err
+		}
+		n += len(seg)
+		p = p[len(seg):]
+	}
+	return n, nil
+}
+
+// stampReader returns a reader yielding r's content with every line
+// timestamped as it is read.
+func stampReader(r io.Reader, layout string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(&timestampWriter{w: pw, layout: layout}, r)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// grepReader returns a reader yielding only the lines of r that match re
+// (or, with invert, that don't), as they arrive.
+func grepReader(r io.Reader, re *regexp.Regexp, invert bool) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				body, _ := splitEOL(line)
+				if re.Match(body) != invert {
+					if _, werr := pw.Write(line); werr != nil {
+						return
+					}
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// followTail reads r until EOF, keeping the last max bytes. Whenever quiet
+// passes with no new input it calls emit with that window, starting at a
+// line boundary once older input has been dropped; at EOF it emits anything
+// not yet sent. If maxWait is set, input that keeps arriving without a pause
+// is still emitted at most maxWait after it first arrived. Memory stays
+// around max plus one read.
+func followTail(r io.Reader, max int, quiet, maxWait time.Duration, emit func([]byte)) error {
+	chunks := make(chan []byte)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunks <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	var window []byte
+	var pendingSince time.Time
+	cut, pending := false, false
+	tail := func() []byte {
+		if cut {
+			if i := bytes.IndexByte(window, '\n'); i >= 0 && i+1 < len(window) {
+				return window[i+1:]
+			}
+		}
+		return window
+	}
+	timer := time.NewTimer(quiet)
+	timer.Stop()
+	for {
+		select {
+		case c, ok := <-chunks:
+			if !ok {
+				if pending {
+					emit(tail())
+				}
+				return readErr
+			}
+			window = append(window, c...)
+			if len(window) > max {
+				// The window starts mid-line unless what it drops ends a line.
+				cut = window[len(window)-max-1] != '\n'
+				window = append([]byte(nil), window[len(window)-max:]...)
+			}
+			if !pending {
+				pendingSince = time.Now()
+			}
+			pending = true
+			wait := quiet
+			if maxWait > 0 {
+				if left := maxWait - time.Since(pendingSince); left < wait {
+					wait = left
+				}
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			if pending {
+				emit(tail())
+				pending = false
+			}
+		}
+	}
+}
+
+// copyLimited copies r to dst until EOF. If progress is set, it is called
+// with the running byte count after every read.
+func copyLimited(dst io.Writer, r io.Reader, progress func(int64)) error {
 	buf := make([]byte, 32*1024)
+	var total int64
 	for {
 		n, err := r.Read(buf)
 		if n > 0 {
 			if _, werr := dst.Write(buf[:n]); werr != nil {
 				return werr
 			}
+			total += int64(n)
+			if progress != nil {
+				progress(total)
+			}
 		}
 		if err == io.EOF {
 			return nil
@@ -107,133 +534,3506 @@ func copyLimited(dst *limitedBuffer, r io.Reader) error {
 	}
 }
 
+// progressBar draws "[####....]  42%  12345/28000 bytes" for a file on the
+// terminal, redrawing at most every 100ms.
+type progressBar struct {
+	tty   io.Writer
+	total int64
+	last  time.Time
+	drawn bool
+}
+
+// newProgressBar returns a bar for f, or nil if f's size isn't known (not a
+// regular file) or there is no terminal to draw on.
+func newProgressBar(f *os.File) *progressBar {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return nil
+	}
+	if tty == nil {
+		return nil
+	}
+	return &progressBar{tty: tty, total: fi.Size()}
+}
+
+func (p *progressBar) update(n int64) {
+	if n < p.total && time.Since(p.last) < 100*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	const width = 30
+	done := int(min(n, p.total) * width / p.total)
+	fmt.Fprintf(p.tty, "\r[%s%s] %3d%%  %d/%d bytes", strings.Repeat("#", done), strings.Repeat(".", width-done),
+		min(n, p.total)*100/p.total, n, p.total)
+	p.drawn = true
+}
+
+// close erases the bar.
+func (p *progressBar) close() {
+	if p.drawn {
+		fmt.Fprint(p.tty, "\r\033[K")
+	}
+}
+
 func printTooLargeOrDie(err error, maxBytes int, hint string) {
+	if errors.Is(err, errMaxRuntime) {
+		fmt.Fprintln(stderr, "rcp: -max-runtime reached; nothing more was copied")
+		exit(exitMaxRuntime)
+	}
 	if e, ok := asTooLarge(err); ok {
 		got := e.got
 		if hint == "" {
 			hint = "<input>"
 		}
-		fmt.Fprintf(os.Stderr, "rcp: %d bytes exceeds limit %d. Refusing.\n\n", got, maxBytes)
-		fmt.Fprintf(os.Stderr, "Tip:\n  RCOPY_MAX_BYTES=%d rcp %s\n\n(Or export RCOPY_MAX_BYTES for this shell.)\n",
-			got+1024, hint)
-		os.Exit(1)
+		fmt.Fprintf(stderr, "rcp: %d bytes exceeds limit %d. Refusing.\n\n", got, maxBytes)
+		if base64Limit > 0 {
+			fmt.Fprintf(stderr, "Tip:\n  rcp -max-base64-bytes %d %s\n\n(The limit came from -max-base64-bytes %d; RCOPY_MAX_BYTES still applies too.)\n",
+				base64.StdEncoding.EncodedLen(got), hint, base64Limit)
+		} else {
+			fmt.Fprintf(stderr, "Tip:\n  RCOPY_MAX_BYTES=%d rcp %s\n\n(Or export RCOPY_MAX_BYTES for this shell.)\n",
+				got+1024, hint)
+		}
+		if fi, err := os.Stat(hint); err == nil && fi.Mode().IsRegular() {
+			fmt.Fprintf(stderr, "\nOr copy it in pieces:\n  rcp -resume %s\n", hint)
+		}
+		exit(1)
 	}
-	fmt.Fprintln(os.Stderr, err)
-	os.Exit(1)
+	fmt.Fprintln(stderr, err)
+	exit(1)
 }
 
-func main() {
-	withCmd := flag.Bool("c", false, "prepend `cat <file>` before file contents")
-	execCmd := flag.String("e", "", "run command via bash -c and prepend the command")
-	help := flag.Bool("h", false, "help")
-	flag.Usage = usage
-	flag.Parse()
+// validateContent checks data against format and returns what should be
+// copied: the data unchanged, or re-indented when pretty is set.
+func validateContent(data []byte, format string, pretty bool) ([]byte, error) {
+	switch format {
+	case "json":
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			var se *json.SyntaxError
+			if errors.As(err, &se) {
+				line, col := lineCol(data, se.Offset)
+				return nil, fmt.Errorf("invalid JSON at line %d, column %d: %v", line, col, err)
+			}
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		if !pretty {
+			return data, nil
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, bytes.TrimSpace(data), "", "  "); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	case "yaml":
+		if pretty {
+			return nil, errors.New("-pretty only works with -validate json")
+		}
+		if err := checkYAML(data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
 
-	// support "/?" and "-?" like the bash version
-	for _, a := range os.Args[1:] {
-		if a == "/?" || a == "-?" || a == "--help" {
-			usage()
+// yamlBlock is a block mapping ('m') or sequence ('s') open at an indent.
+type yamlBlock struct {
+	indent int
+	kind   byte
+	keys   map[string]bool
+}
+
+// yamlChecker holds checkYAML's state between lines. The indents it records
+// are -1 for the document itself; yamlNone means unset.
+type yamlChecker struct {
+	stack    []yamlBlock
+	root     bool   // the document's root node has started
+	child    int    // a nested node must be indented deeper than this...
+	childSeq bool   // ...or be a sequence at child itself (under a key)
+	plain    int    // a plain value continues on lines deeper than this
+	scalar   int    // a block scalar (| or >) holds lines deeper than this
+	open     []byte // quotes and flow brackets still open, innermost last
+	openLine int
+	openCol  int
+}
+
+const yamlNone = -2
+
+func yamlErr(line, col int, format string, args ...any) error {
+	return fmt.Errorf("invalid YAML at line %d, column %d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+// checkYAML reports the first structural error in the YAML in data: tabs in
+// indentation, indentation that matches no enclosing block, a sequence entry
+// where a mapping key belongs (or the other way round), unterminated quotes
+// or flow collections, "a: b: c" in a plain value, and duplicate keys. It is
+// not a full YAML parser; anchors, tags and aliases are taken on trust, and
+// complex keys (?) are refused.
+func checkYAML(data []byte) error {
+	c := &yamlChecker{}
+	c.reset()
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for n, raw := range strings.Split(text, "\n") {
+		line := n + 1
+		s := strings.TrimRight(raw, "\r")
+		marker := s == "---" || s == "..." || strings.HasPrefix(s, "--- ") || strings.HasPrefix(s, "... ")
+		if len(c.open) > 0 {
+			if marker {
+				break
+			}
+			if err := c.scan(s, line, 1); err != nil {
+				return err
+			}
+			continue
+		}
+		body := strings.TrimLeft(s, " ")
+		ind := len(s) - len(body)
+		if c.scalar != yamlNone {
+			if !marker && (strings.TrimSpace(s) == "" || ind > c.scalar) {
+				continue
+			}
+			c.scalar = yamlNone
+		}
+		if t := strings.TrimLeft(body, " \t"); t == "" || t[0] == '#' {
+			continue
+		}
+		switch {
+		case marker:
+			c.reset()
+			if rest := strings.TrimSpace(s[3:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				if err := c.value(rest, -1, line, 5, false); err != nil {
+					return err
+				}
+				c.root = true
+			}
+			continue
+		case ind == 0 && body[0] == '%':
+			continue
+		case body[0] == '\t':
+			return yamlErr(line, ind+1, "tabs can't be used for indentation")
+		}
+		if err := c.line(body, ind, line); err != nil {
+			return err
 		}
 	}
-	if *help {
-		usage()
+	if len(c.open) > 0 {
+		what := map[byte]string{'"': "double-quoted string", '\'': "single-quoted string", '[': "flow sequence ([)", '{': "flow mapping ({)"}[c.open[0]]
+		return yamlErr(c.openLine, c.openCol, "unterminated %s", what)
 	}
+	return nil
+}
 
-	maxBytes := getenvInt("RCOPY_MAX_BYTES", defaultMaxBytes)
+// reset starts a new document.
+func (c *yamlChecker) reset() {
+	*c = yamlChecker{child: yamlNone, plain: yamlNone, scalar: yamlNone}
+}
 
-	// Validate combos
-	if *execCmd != "" && *withCmd {
-		fmt.Fprintln(os.Stderr, "rcp: -c can't be used with -e")
-		os.Exit(2)
+// line checks one line holding s at indent ind.
+func (c *yamlChecker) line(s string, ind, line int) error {
+	seq := isYAMLSeqEntry(s)
+	if c.child != yamlNone && (ind > c.child || ind == c.child && c.childSeq && seq) {
+		parent := c.child
+		c.child = yamlNone
+		return c.node(s, ind, line, parent, true)
 	}
+	c.child = yamlNone
+	if c.plain != yamlNone && ind > c.plain {
+		// The next line of a multi-line plain value.
+		if i := plainColon(s); i >= 0 {
+			return yamlErr(line, ind+i+1, "mapping values are not allowed here")
+		}
+		return nil
+	}
+	c.plain = yamlNone
 
-	args := flag.Args()
-
-	mode := ""
-	src := ""
+	for len(c.stack) > 0 && c.stack[len(c.stack)-1].indent > ind {
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+	// A sequence can sit at the same indent as the key it belongs to.
+	if n := len(c.stack); n > 1 && !seq && c.stack[n-1].kind == 's' && c.stack[n-1].indent == ind && c.stack[n-2].indent == ind {
+		c.stack = c.stack[:n-1]
+	}
+	switch {
+	case len(c.stack) == 0 && !c.root:
+		return c.node(s, ind, line, -1, true)
+	case len(c.stack) == 0 || c.stack[len(c.stack)-1].indent != ind:
+		if len(c.stack) == 0 {
+			return yamlErr(line, ind+1, "unexpected content after the document's root value")
+		}
+		return yamlErr(line, ind+1, "indentation doesn't match any enclosing block")
+	}
+	return c.node(s, ind, line, ind, false)
+}
 
-	if *execCmd != "" {
-		mode = "exec"
-	} else if len(args) >= 1 {
-		if args[0] == "-" {
-			mode = "stdin"
-		} else {
-			mode = "file"
-			src = args[0]
+// node checks the node s at indent ind. With opens it starts a new block
+// nested under parent; otherwise it is the next entry of the innermost block.
+func (c *yamlChecker) node(s string, ind, line, parent int, opens bool) error {
+	c.plain = yamlNone
+	kind := byte('m')
+	if isYAMLSeqEntry(s) {
+		kind = 's'
+	}
+	key, val, vcol, isKey := yamlKey(s)
+	if kind == 'm' && !isKey {
+		if strings.HasPrefix(s, "?") {
+			return yamlErr(line, ind+1, "complex keys (?) aren't supported")
 		}
-	} else {
-		if isStdinPiped() {
-			mode = "stdin"
-		} else {
-			usage()
+		if !opens {
+			if c.stack[len(c.stack)-1].kind == 's' {
+				return yamlErr(line, ind+1, "expected a sequence entry (- ...)")
+			}
+			return yamlErr(line, ind+1, "expected a mapping key (key: value)")
 		}
+		c.root = true
+		return c.value(s, parent, line, ind+1, false)
 	}
 
-	var out limitedBuffer
-	out.max = maxBytes
-
-	switch mode {
-	case "exec":
-		if _, err := out.Write([]byte(*execCmd + "\n")); err != nil {
-			printTooLargeOrDie(err, maxBytes, "")
+	if opens {
+		c.stack = append(c.stack, yamlBlock{indent: ind, kind: kind, keys: map[string]bool{}})
+	} else if top := c.stack[len(c.stack)-1]; top.kind != kind {
+		if top.kind == 's' {
+			return yamlErr(line, ind+1, "expected a sequence entry (- ...), found a mapping key")
 		}
+		return yamlErr(line, ind+1, "expected a mapping key, found a sequence entry")
+	}
+	c.root = true
 
-		cmd := exec.Command("bash", "-c", *execCmd)
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			printTooLargeOrDie(err, maxBytes, "")
+	if kind == 's' {
+		rest := strings.TrimLeft(s[1:], " \t")
+		if rest == "" || rest[0] == '#' {
+			c.child, c.childSeq = ind, false
+			return nil
+		}
+		rind := ind + len(s) - len(rest)
+		if isYAMLSeqEntry(rest) || yamlIsKey(rest) {
+			return c.node(rest, rind, line, ind, true)
 		}
-		cmd.Stderr = os.Stderr
+		return c.value(rest, ind, line, rind+1, false)
+	}
 
-		if err := cmd.Start(); err != nil {
-			printTooLargeOrDie(err, maxBytes, "")
+	top := &c.stack[len(c.stack)-1]
+	if key != "<<" {
+		if top.keys[key] {
+			return yamlErr(line, ind+1, "duplicate key %s", key)
 		}
+		top.keys[key] = true
+	}
+	return c.value(val, ind, line, ind+vcol+1, true)
+}
 
-		if err := copyLimited(&out, stdout); err != nil {
-			printTooLargeOrDie(err, maxBytes, "<input>")
+// value checks v, the value starting at column col of a node owned by the
+// block at indent owner. afterKey says v follows "key:".
+func (c *yamlChecker) value(v string, owner, line, col int, afterKey bool) error {
+	// Anchors (&a) and tags (!t) come before the value itself.
+	for len(v) > 0 && (v[0] == '&' || v[0] == '!') {
+		i := strings.IndexAny(v, " \t")
+		if i < 0 {
+			v = ""
+			break
+		}
+		rest := strings.TrimLeft(v[i:], " \t")
+		col += len(v) - len(rest)
+		v = rest
+	}
+	switch {
+	case v == "" || v[0] == '#':
+		c.child, c.childSeq = owner, afterKey
+	case v[0] == '|' || v[0] == '>':
+		if !yamlBlockHeader.MatchString(v) {
+			return yamlErr(line, col, "bad block scalar header %q", v)
 		}
+		c.scalar = owner
+	case v[0] == '"' || v[0] == '\'' || v[0] == '[' || v[0] == '{':
+		c.open = []byte{v[0]}
+		c.openLine, c.openCol = line, col
+		return c.scan(v[1:], line, col+1)
+	case v[0] == '*':
+	case strings.IndexByte(",]}%@`", v[0]) >= 0:
+		return yamlErr(line, col, "a plain value can't start with %q", v[0])
+	case afterKey && isYAMLSeqEntry(v):
+		return yamlErr(line, col, "a sequence can't start on the line of its key")
+	default:
+		if i := plainColon(v); i >= 0 {
+			return yamlErr(line, col+i, "mapping values are not allowed here")
+		}
+		c.plain = owner
+	}
+	return nil
+}
 
-		if err := cmd.Wait(); err != nil {
-			// Command failed; still exit non-zero
-			printTooLargeOrDie(err, maxBytes, "")
+// yamlBlockHeader matches a block scalar header: | or >, then optional
+// indentation and chomping indicators, then maybe a comment.
+var yamlBlockHeader = regexp.MustCompile(`^[|>][1-9+-]{0,2}[ \t]*(#.*)?$`)
+
+// scan follows s, starting at column col, through the quoted string or flow
+// collection open in c. Once everything has closed, only a comment may follow.
+func (c *yamlChecker) scan(s string, line, col int) error {
+	prev := byte(',') // a quote only opens a string at the start of a flow node
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if len(c.open) == 0 {
+			if rest := strings.TrimLeft(s[i:], " \t"); rest != "" && rest[0] != '#' {
+				return yamlErr(line, col+len(s)-len(rest), "unexpected text after the value")
+			}
+			return nil
+		}
+		if q := c.open[len(c.open)-1]; q == '"' || q == '\'' {
+			switch {
+			case q == '"' && ch == '\\':
+				i++
+			case ch == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				i++
+			case ch == q:
+				c.open = c.open[:len(c.open)-1]
+				prev = ch
+			}
+			continue
+		}
+		switch {
+		case ch == ' ' || ch == '\t':
+			continue
+		case ch == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return nil
+		case (ch == '"' || ch == '\'') && strings.IndexByte("[{,:", prev) >= 0:
+			c.open = append(c.open, ch)
+		case ch == '[' || ch == '{':
+			c.open = append(c.open, ch)
+		case ch == ']' || ch == '}':
+			want := map[byte]byte{']': '[', '}': '{'}[ch]
+			if c.open[len(c.open)-1] != want {
+				return yamlErr(line, col+i, "unexpected %q", ch)
+			}
+			c.open = c.open[:len(c.open)-1]
 		}
+		prev = ch
+	}
+	return nil
+}
 
-	case "stdin":
-		if *withCmd {
-			fmt.Fprintln(os.Stderr, "rcp: -c only works with a filename (rcp -c <file>)")
-			os.Exit(2)
+func isYAMLSeqEntry(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ") || strings.HasPrefix(s, "-\t")
+}
+
+func yamlIsKey(s string) bool {
+	_, _, _, ok := yamlKey(s)
+	return ok
+}
+
+// yamlKey splits s at the colon ending its key, if it is "key: value" or
+// "key:". vcol is the offset of the value in s.
+func yamlKey(s string) (key, value string, vcol int, ok bool) {
+	end := -1
+	switch s[0] {
+	case '"', '\'':
+		for i := 1; i < len(s); i++ {
+			if s[0] == '"' && s[i] == '\\' {
+				i++
+			} else if s[i] == s[0] {
+				if s[0] == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+					i++
+					continue
+				}
+				end = i + 1
+				break
+			}
 		}
-		if err := copyLimited(&out, os.Stdin); err != nil {
-			printTooLargeOrDie(err, maxBytes, "<input>")
+		if end < 0 {
+			return "", "", 0, false
+		}
+		rest := strings.TrimLeft(s[end:], " ")
+		if !strings.HasPrefix(rest, ":") || len(rest) > 1 && rest[1] != ' ' && rest[1] != '\t' {
+			return "", "", 0, false
+		}
+		end = len(s) - len(rest)
+	case '!', '&':
+		// A tag or anchor comes before the key it applies to.
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			return "", "", 0, false
+		}
+		rest := strings.TrimLeft(s[i:], " \t")
+		if rest == "" {
+			return "", "", 0, false
+		}
+		key, value, vcol, ok = yamlKey(rest)
+		return key, value, vcol + len(s) - len(rest), ok
+	case '[', '{', '-', '?', '|', '>', '#':
+		if s[0] != '-' || isYAMLSeqEntry(s) {
+			return "", "", 0, false
+		}
+		fallthrough
+	default:
+		if end = plainColon(s); end < 0 {
+			return "", "", 0, false
 		}
+	}
+	key = strings.TrimRight(s[:end], " ")
+	value = strings.TrimLeft(s[end+1:], " \t")
+	return key, value, len(s) - len(value), true
+}
 
-	case "file":
-		f, err := os.Open(src)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "rcp: not a file: %s\n", src)
-			os.Exit(1)
+// plainColon returns the index of the first ": " (or final ":") in the plain
+// text s, ignoring a trailing comment, or -1.
+func plainColon(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '#' && i > 0 && (s[i-1] == ' ' || s[i-1] == '\t'):
+			return -1
+		case s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ' || s[i+1] == '\t'):
+			return i
 		}
-		defer f.Close()
+	}
+	return -1
+}
 
-		if *withCmd {
-			if _, err := out.Write([]byte("cat " + src + "\n")); err != nil {
-				printTooLargeOrDie(err, maxBytes, src)
+// jsonPath returns the value at path in the JSON document data. path is a
+// dotted list of object keys and array indices, e.g. ".items.0.name"; "."
+// is the whole document. A string value is returned unquoted, anything else
+// as it appears in data.
+func jsonPath(data []byte, path string) ([]byte, error) {
+	if _, err := validateContent(data, "json", false); err != nil {
+		return nil, err
+	}
+	cur := json.RawMessage(bytes.TrimSpace(data))
+	var steps []string
+	if path != "." {
+		steps = strings.Split(strings.TrimPrefix(path, "."), ".")
+	}
+	at := ""
+	for _, step := range steps {
+		where := at
+		if where == "" {
+			where = "the top level"
+		}
+		switch cur[0] {
+		case '{':
+			var obj map[string]json.RawMessage
+			json.Unmarshal(cur, &obj)
+			v, ok := obj[step]
+			if !ok {
+				return nil, fmt.Errorf("no key %q at %s", step, where)
+			}
+			cur = v
+		case '[':
+			var arr []json.RawMessage
+			json.Unmarshal(cur, &arr)
+			i, err := strconv.Atoi(step)
+			if err != nil {
+				return nil, fmt.Errorf("%s is an array; %q is not an index", where, step)
+			}
+			if i < 0 || i >= len(arr) {
+				return nil, fmt.Errorf("index %d out of range at %s (length %d)", i, where, len(arr))
 			}
+			cur = arr[i]
+		default:
+			return nil, fmt.Errorf("%s is not an object or array, so it has no %q", where, step)
 		}
+		at += "." + step
+	}
+	if cur[0] == '"' {
+		var s string
+		json.Unmarshal(cur, &s)
+		return []byte(s), nil
+	}
+	return cur, nil
+}
 
-		if err := copyLimited(&out, f); err != nil {
-			printTooLargeOrDie(err, maxBytes, src)
+// bases are the number bases -base converts between, with the prefix each may
+// carry on input.
+var bases = map[string]string{"2": "0b", "8": "0o", "10": "", "16": "0x"}
+
+// parseBases parses a -base value such as "16:10".
+func parseBases(s string) (from, to int, ok bool) {
+	f, t, ok := strings.Cut(s, ":")
+	_, okf := bases[f]
+	_, okt := bases[t]
+	if !ok || !okf || !okt {
+		return 0, 0, false
+	}
+	from, _ = strconv.Atoi(f)
+	to, _ = strconv.Atoi(t)
+	return from, to, true
+}
+
+// convertBase reads data, trimmed, as an integer in base from and returns it
+// written in base to. The input may have a sign and the base's prefix (0x,
+// 0o, 0b); the output has neither prefix nor trailing newline. There is no
+// size limit.
+func convertBase(data []byte, from, to int) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	digits, neg := strings.CutPrefix(s, "-")
+	if !neg {
+		digits = strings.TrimPrefix(digits, "+")
+	}
+	if p := bases[strconv.Itoa(from)]; p != "" && len(digits) > len(p) && strings.EqualFold(digits[:len(p)], p) {
+		digits = digits[len(p):]
+	}
+	n, ok := new(big.Int).SetString(digits, from)
+	if !ok || strings.HasPrefix(digits, "+") || strings.HasPrefix(digits, "-") || strings.Contains(digits, "_") {
+		return nil, fmt.Errorf("%q is not a base-%d number", s, from)
+	}
+	if neg {
+		n.Neg(n)
+	}
+	return []byte(n.Text(to)), nil
+}
+
+// calc evaluates an arithmetic expression of numbers, + - * / %, and
+// parentheses. Division is exact: 7/2 is 3.5, and an integer result is
+// printed without a fraction. % needs whole numbers.
+func calc(expr string) (string, error) {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return "", fmt.Errorf("invalid expression: %v", err)
+	}
+	v, err := evalConst(e)
+	if err != nil {
+		return "", err
+	}
+	if v.Kind() == constant.Int {
+		return v.ExactString(), nil
+	}
+	if i := constant.ToInt(v); i.Kind() == constant.Int {
+		return i.ExactString(), nil
+	}
+	f, _ := constant.Float64Val(v)
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+func evalConst(e ast.Expr) (constant.Value, error) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.INT || e.Kind == token.FLOAT {
+			return constant.MakeFromLiteral(e.Value, e.Kind, 0), nil
+		}
+	case *ast.ParenExpr:
+		return evalConst(e.X)
+	case *ast.UnaryExpr:
+		if e.Op == token.ADD || e.Op == token.SUB {
+			x, err := evalConst(e.X)
+			if err != nil {
+				return nil, err
+			}
+			return constant.UnaryOp(e.Op, x, 0), nil
 		}
+	case *ast.BinaryExpr:
+		if !slices.Contains([]token.Token{token.ADD, token.SUB, token.MUL, token.QUO, token.REM}, e.Op) {
+			break
+		}
+		x, err := evalConst(e.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := evalConst(e.Y)
+		if err != nil {
+			return nil, err
+		}
+		if (e.Op == token.QUO || e.Op == token.REM) && constant.Sign(y) == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if e.Op == token.REM {
+			x, y = constant.ToInt(x), constant.ToInt(y)
+			if x.Kind() != constant.Int || y.Kind() != constant.Int {
+				return nil, errors.New("% needs whole numbers")
+			}
+		}
+		return constant.BinaryOp(x, e.Op, y), nil
+	}
+	return nil, fmt.Errorf("at column %d: only numbers, + - * / %% and parentheses are allowed", e.Pos())
+}
 
-	default:
-		usage()
+// decompressMaxBytes caps -decompress output regardless of RCOPY_MAX_BYTES,
+// so a small archive can't expand without bound.
+const decompressMaxBytes = 64 << 20
+
+// gunzip decompresses data if it starts with the gzip magic bytes and
+// returns it unchanged otherwise. Output past max bytes is an error.
+func gunzip(data []byte, max int) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, fmt.Errorf("decompresses to more than %d bytes", max)
 	}
+	return out, nil
+}
 
-	// Emit OSC52 (stdout ONLY)
-	b64 := base64.StdEncoding.EncodeToString(out.buf.Bytes())
-	fmt.Printf("\033]52;c;%s\033\\", b64)
+// peekMaxBytes is how much of the clipboard -peek shows.
+const peekMaxBytes = 2000
 
-	// Status to stderr
-	fmt.Fprintf(os.Stderr, "Sent %d bytes via OSC52\n", out.n)
+// peekText returns data for display, cut to at most max bytes (at a UTF-8
+// boundary) with a note saying how much was left out.
+func peekText(data []byte, max int) string {
+	if len(data) <= max {
+		return string(data)
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... (%d more bytes)", data[:cut], len(data)-cut)
+}
+
+// lineCol converts a byte offset into a 1-based line and column.
+func lineCol(data []byte, off int64) (int, int) {
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	line, col := 1, 1
+	for _, b := range data[:off] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
 }
 
+// dataURIMaxBytes caps the content -data-uri will encode; data URIs are
+// meant for small assets.
+const dataURIMaxBytes = 32 * 1024
+
+// dataURI renders data as a base64 data: URI. The MIME type comes from
+// name's extension when known, otherwise from sniffing the content.
+func dataURI(name string, data []byte) string {
+	typ := ""
+	if ext := filepath.Ext(name); ext != "" {
+		typ = mime.TypeByExtension(ext)
+	}
+	if typ == "" {
+		typ = http.DetectContentType(data)
+	}
+	typ = strings.ReplaceAll(typ, " ", "")
+	return "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// describeContent writes a report on data's line endings, encoding and size.
+func describeContent(w io.Writer, data []byte) {
+	crlf := bytes.Count(data, []byte("\r\n"))
+	lf := bytes.Count(data, []byte("\n")) - crlf
+	endings := "none"
+	switch {
+	case crlf > 0 && lf > 0:
+		endings = fmt.Sprintf("mixed (%d LF, %d CRLF)", lf, crlf)
+	case crlf > 0:
+		endings = "CRLF"
+	case lf > 0:
+		endings = "LF"
+	}
+	lineCount := lf + crlf
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lineCount++
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Fprintf(w, "Bytes:        %d\n", len(data))
+	fmt.Fprintf(w, "Lines:        %d\n", lineCount)
+	fmt.Fprintf(w, "Line endings: %s\n", endings)
+	fmt.Fprintf(w, "Valid UTF-8:  %s\n", yesNo(utf8.Valid(data)))
+	fmt.Fprintf(w, "BOM:          %s\n", yesNo(bytes.HasPrefix(data, []byte("\xef\xbb\xbf"))))
+	fmt.Fprintf(w, "Binary:       %s\n", yesNo(looksBinary(data)))
+}
+
+// looksBinary guesses whether data is binary: it has a NUL byte, or more
+// than a tenth of its first 8 KiB is control characters other than
+// whitespace.
+func looksBinary(data []byte) bool {
+	head := data[:min(len(data), 8192)]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true
+	}
+	ctrl := 0
+	for _, c := range head {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' && c != '\f' && c != '\b' && c != 0x1b {
+			ctrl++
+		}
+	}
+	return ctrl*10 > len(head)
+}
+
+// pasteTimeout bounds a -paste-service request.
+const pasteTimeout = 30 * time.Second
+
+// pasteContent POSTs data to a paste service and returns the link from its
+// reply: the "url" field of a JSON object, or else the first line of the body.
+// auth, if set, is an extra "Name: value" header.
+func pasteContent(ctx context.Context, endpoint, format, field, auth string, data []byte) (string, error) {
+	var body io.Reader
+	ctype := "text/plain; charset=utf-8"
+	switch format {
+	case "form":
+		body = strings.NewReader(url.Values{field: {string(data)}}.Encode())
+		ctype = "application/x-www-form-urlencoded"
+	case "json":
+		b, err := json.Marshal(map[string]string{field: string(data)})
+		if err != nil {
+			return "", err
+		}
+		body = bytes.NewReader(b)
+		ctype = "application/json"
+	default:
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", ctype)
+	if auth != "" {
+		name, value, ok := strings.Cut(auth, ":")
+		if !ok {
+			return "", errors.New(`RCOPY_PASTE_AUTH must look like "Name: value"`)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	resp, err := (&http.Client{Timeout: pasteTimeout}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+	var obj struct {
+		URL string `json:"url"`
+	}
+	if json.Unmarshal(reply, &obj) == nil && obj.URL != "" {
+		return obj.URL, nil
+	}
+	link, _, _ := strings.Cut(strings.TrimSpace(string(reply)), "\n")
+	if link == "" {
+		return "", errors.New("empty reply")
+	}
+	return strings.TrimSpace(link), nil
+}
+
+// hostHeader returns the line -host puts before the content.
+func hostHeader(withUser bool) string {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "unknown"
+	}
+	h := "# host: " + name
+	if withUser {
+		if u, err := user.Current(); err == nil {
+			h += " user: " + u.Username
+		} else if u := getenv("USER"); u != "" {
+			h += " user: " + u
+		}
+	}
+	return h + "\n"
+}
+
+// inlineImageProtocol picks the inline graphics protocol for the current
+// terminal, or "" if it doesn't support one we know.
+func inlineImageProtocol() string {
+	term := getenv("TERM")
+	switch {
+	case getenv("TERM_PROGRAM") == "iTerm.app", getenv("TERM_PROGRAM") == "WezTerm":
+		return "iterm"
+	case strings.Contains(term, "kitty"), getenv("KITTY_WINDOW_ID") != "":
+		return "kitty"
+	}
+	return ""
+}
+
+// writeInlineImage draws img on w using the given protocol.
+func writeInlineImage(w io.Writer, proto, mime string, img []byte) error {
+	b64 := base64.StdEncoding.EncodeToString(img)
+	switch proto {
+	case "iterm":
+		_, err := fmt.Fprintf(w, "\033]1337;File=inline=1;size=%d:%s\a\n", len(img), b64)
+		return err
+	case "kitty":
+		// kitty only takes PNG directly; other formats would need decoding.
+		if mime != "image/png" {
+			return fmt.Errorf("kitty inline display needs PNG, got %s", mime)
+		}
+		const chunk = 4096
+		for i := 0; i < len(b64); i += chunk {
+			end := min(i+chunk, len(b64))
+			more := 0
+			if end < len(b64) {
+				more = 1
+			}
+			keys := fmt.Sprintf("m=%d", more)
+			if i == 0 {
+				keys = "a=T,f=100," + keys
+			}
+			if _, err := fmt.Fprintf(w, "\033_G%s;%s\033\\", keys, b64[i:end]); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+	return fmt.Errorf("no inline image support detected (TERM=%s)", getenv("TERM"))
+}
+
+// defaultPromptRegex matches common prompts at the start of a line: "$ ",
+// "# ", "% ", "> ", optionally after "user@host:dir" or "[user@host dir]".
+const defaultPromptRegex = `^(\[[^\]]*\] ?|[\w.-]+@[\w.-]+(:[^$#%>\s]*)? ?)?[$#%>] `
+
+// stripPrompt removes whatever re matches at the start of each line.
+func stripPrompt(data []byte, re *regexp.Regexp) []byte {
+	var out bytes.Buffer
+	for _, line := range lines(data) {
+		if loc := re.FindIndex(line); loc != nil && loc[0] == 0 {
+			line = line[loc[1]:]
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+var commentMarkers = map[string]string{
+	"hash":      "#",
+	"slash":     "//",
+	"semicolon": ";",
+}
+
+// lines splits data after each newline, keeping the newlines.
+func lines(data []byte) [][]byte {
+	ls := bytes.SplitAfter(data, []byte("\n"))
+	if len(ls) > 0 && len(ls[len(ls)-1]) == 0 {
+		ls = ls[:len(ls)-1]
+	}
+	return ls
+}
+
+// splitEOL separates a line from its trailing "\n" or "\r\n".
+func splitEOL(line []byte) ([]byte, []byte) {
+	body := bytes.TrimRight(line, "\r\n")
+	return body, line[len(body):]
+}
+
+// commentStart returns the index where a comment starting with marker begins
+// in line, or -1. Markers inside quotes or glued to preceding text don't count.
+// A quote with no closing quote later on the line, like the one in O'Brien,
+// is just text.
+func commentStart(line []byte, marker string) int {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '"' || c == '\'' {
+			if end := closingQuote(line, i); end >= 0 {
+				i = end
+				continue
+			}
+		}
+		if bytes.HasPrefix(line[i:], []byte(marker)) && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return i
+		}
+	}
+	return -1
+}
+
+// closingQuote returns the index of the quote closing the one at line[open],
+// or -1. Backslash escapes only count inside double quotes.
+func closingQuote(line []byte, open int) int {
+	q := line[open]
+	for i := open + 1; i < len(line); i++ {
+		if line[i] == '\\' && q == '"' {
+			i++
+		} else if line[i] == q {
+			return i
+		}
+	}
+	return -1
+}
+
+func stripComments(data []byte, marker string) []byte {
+	var out bytes.Buffer
+	for _, line := range lines(data) {
+		body, eol := splitEOL(line)
+		i := commentStart(body, marker)
+		if i < 0 {
+			out.Write(line)
+			continue
+		}
+		kept := bytes.TrimRight(body[:i], " \t")
+		if len(bytes.TrimSpace(kept)) == 0 {
+			continue
+		}
+		out.Write(kept)
+		out.Write(eol)
+	}
+	return out.Bytes()
+}
+
+// escapeLiteral renders data as a string literal in the given language.
+func escapeLiteral(data []byte, lang string) []byte {
+	switch lang {
+	case "go":
+		return []byte(strconv.Quote(string(data)))
+	case "json":
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(string(data))
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	case "shell":
+		return []byte("'" + strings.ReplaceAll(string(data), "'", `'\''`) + "'")
+	case "python":
+		var buf bytes.Buffer
+		buf.WriteByte('"')
+		for _, c := range data {
+			switch c {
+			case '\\', '"':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				if c < 0x20 || c == 0x7f {
+					fmt.Fprintf(&buf, `\x%02x`, c)
+				} else {
+					buf.WriteByte(c)
+				}
+			}
+		}
+		buf.WriteByte('"')
+		return buf.Bytes()
+	}
+	return data
+}
+
+const clipboardReadTimeout = 2 * time.Second
+
+// localPasteCommand returns a command that prints the local selection
+// ("clipboard" or "primary"), or nil if there is no display or no known tool.
+func localPasteCommand(sel string) []string {
+	candidates := [][]string{}
+	if getenv("WAYLAND_DISPLAY") != "" {
+		if sel == "primary" {
+			candidates = append(candidates, []string{"wl-paste", "-n", "-p"})
+		} else {
+			candidates = append(candidates, []string{"wl-paste", "-n"})
+		}
+	}
+	if getenv("DISPLAY") != "" {
+		xselFlag := "-b"
+		if sel == "primary" {
+			xselFlag = "-p"
+		}
+		candidates = append(candidates,
+			[]string{"xclip", "-o", "-selection", sel},
+			[]string{"xsel", "-o", xselFlag})
+	}
+	if _, err := os.Stat("/usr/bin/pbpaste"); err == nil && sel == "clipboard" {
+		candidates = append(candidates, []string{"pbpaste"})
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// localCopyCommand returns the command that sets the local sel ("clipboard"
+// or "primary") from its stdin, picked like localPasteCommand, or nil.
+func localCopyCommand(sel string) []string {
+	candidates := [][]string{}
+	if getenv("WAYLAND_DISPLAY") != "" {
+		if sel == "primary" {
+			candidates = append(candidates, []string{"wl-copy", "-p"})
+		} else {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+	}
+	if getenv("DISPLAY") != "" {
+		xselFlag := "-b"
+		if sel == "primary" {
+			xselFlag = "-p"
+		}
+		candidates = append(candidates,
+			[]string{"xclip", "-i", "-selection", sel},
+			[]string{"xsel", "-i", xselFlag})
+	}
+	if _, err := os.Stat("/usr/bin/pbcopy"); err == nil && sel == "clipboard" {
+		candidates = append(candidates, []string{"pbcopy"})
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// notifyCommand returns the command that shows a desktop notification on
+// goos: osascript on macOS, a PowerShell toast on Windows, notify-send
+// elsewhere.
+func notifyCommand(goos, title, body string) []string {
+	switch goos {
+	case "darwin":
+		return []string{"osascript", "-e", "display notification " + strconv.Quote(body) + " with title " + strconv.Quote(title)}
+	case "windows":
+		ps := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+		script := `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode(` + ps(title) + `)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode(` + ps(body) + `)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('rcp').Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+		return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}
+	default:
+		return []string{"notify-send", "--app-name=rcp", title, body}
+	}
+}
+
+// notify shows a desktop notification, or says why it couldn't. It never
+// fails the copy.
+func notify(title, body string) {
+	c := notifyCommand(runtime.GOOS, title, body)
+	if _, err := exec.LookPath(c[0]); err != nil {
+		fmt.Fprintf(stderr, "rcp: -notify: %s not found; skipping\n", c[0])
+		return
+	}
+	if err := exec.Command(c[0], c[1:]...).Run(); err != nil {
+		fmt.Fprintf(stderr, "rcp: -notify: %s: %v\n", c[0], err)
+	}
+}
+
+// readSelection returns the contents of OSC52 selection sel. The clipboard
+// and primary selection are read with a local paste tool when there is one;
+// otherwise, and for the other selections, the terminal is asked via OSC52.
+func readSelection(sel string) ([]byte, error) {
+	local := map[string]string{"c": "clipboard", "p": "primary"}[sel]
+	if local != "" {
+		if c := localPasteCommand(local); c != nil {
+			return exec.Command(c[0], c[1:]...).Output()
+		}
+	}
+	return queryOSC52(sel, clipboardReadTimeout)
+}
+
+// queryOSC52 asks the terminal for selection sel with an OSC52 read request
+// and decodes its reply. A real terminal is put in raw mode while it answers.
+func queryOSC52(sel string, timeout time.Duration) ([]byte, error) {
+	term, ok := tty.(io.ReadWriter)
+	if !ok {
+		return nil, errors.New("no terminal to ask")
+	}
+	if f, ok := term.(*os.File); ok {
+		restore, err := ttyRaw(f)
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
+
+	if _, err := io.WriteString(term, "\033]52;"+sel+";?\033\\"); err != nil {
+		return nil, err
+	}
+	reply, err := readOSCReply(term, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseOSC52Reply(reply)
+}
+
+// ttyRaw puts tty into raw, no-echo mode and returns a func that undoes it.
+// stty gets a descriptor of its own: handing it tty would switch tty to
+// blocking mode, and read deadlines on it would stop working.
+func ttyRaw(tty *os.File) (func(), error) {
+	in, err := os.Open(tty.Name())
+	if err != nil {
+		return nil, err
+	}
+	stty := func(args ...string) ([]byte, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = in
+		return cmd.Output()
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		in.Close()
+		return nil, fmt.Errorf("can't read terminal mode: %v", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		in.Close()
+		return nil, fmt.Errorf("can't set raw mode: %v", err)
+	}
+	return func() {
+		stty(strings.TrimSpace(string(saved)))
+		in.Close()
+	}, nil
+}
+
+// readOSCReply reads from r until an OSC terminator (ST or BEL) arrives or
+// timeout passes. A terminal that supports read deadlines is read directly,
+// so nothing is left reading from it after a timeout.
+func readOSCReply(r io.Reader, timeout time.Duration) ([]byte, error) {
+	errNoReply := errors.New("no reply from terminal (OSC52 reads may be disabled)")
+	read := func() ([]byte, error) {
+		var reply []byte
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			reply = append(reply, buf[:n]...)
+			if bytes.HasSuffix(reply, []byte("\033\\")) || bytes.HasSuffix(reply, []byte("\a")) {
+				return reply, nil
+			}
+			if err != nil {
+				return reply, err
+			}
+		}
+	}
+	if d, ok := r.(interface{ SetReadDeadline(time.Time) error }); ok && d.SetReadDeadline(time.Now().Add(timeout)) == nil {
+		defer d.SetReadDeadline(time.Time{})
+		reply, err := read()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errNoReply
+		}
+		return reply, err
+	}
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := read()
+		done <- result{b, err}
+	}()
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-time.After(timeout):
+		return nil, errNoReply
+	}
+}
+
+// parseOSC52Reply extracts and decodes the payload of "ESC ] 52 ; sel ; data ST".
+func parseOSC52Reply(reply []byte) ([]byte, error) {
+	i := bytes.Index(reply, []byte("\033]52;"))
+	if i < 0 {
+		return nil, errors.New("unexpected reply from terminal")
+	}
+	body := reply[i+len("\033]52;"):]
+	body = bytes.TrimSuffix(bytes.TrimSuffix(body, []byte("\033\\")), []byte("\a"))
+	_, payload, ok := bytes.Cut(body, []byte(";"))
+	if !ok {
+		return nil, errors.New("unexpected reply from terminal")
+	}
+	return base64.StdEncoding.DecodeString(string(payload))
+}
+
+// probeOSC52 checks that the terminal accepts OSC52 writes and answers reads
+// by sending a short marker to the clipboard and reading it back. It reads
+// the clipboard first and puts it back afterwards; if that first read fails,
+// nothing was written.
+func probeOSC52() error {
+	if tty == nil {
+		return errors.New("no terminal")
+	}
+	saved, err := queryOSC52("c", clipboardReadTimeout)
+	if err != nil {
+		return err
+	}
+	marker := []byte("rcp-probe")
+	if _, err := writeOSC52(tty, "c", marker, false); err != nil {
+		return err
+	}
+	got, err := queryOSC52("c", clipboardReadTimeout)
+	if err == nil {
+		err = verifyClipboard(got, marker)
+	}
+	if _, werr := writeOSC52(tty, "c", saved, false); err == nil && werr != nil {
+		err = fmt.Errorf("can't restore the clipboard: %v", werr)
+	}
+	return err
+}
+
+// verifyClipboard compares what the terminal reports holding with sent and
+// describes any difference.
+func verifyClipboard(got, sent []byte) error {
+	switch {
+	case bytes.Equal(got, sent):
+		return nil
+	case len(got) < len(sent) && bytes.HasPrefix(sent, got):
+		return fmt.Errorf("clipboard holds only the first %d of %d bytes (truncated by the terminal?)", len(got), len(sent))
+	}
+	return fmt.Errorf("clipboard holds %d bytes that differ from the %d sent", len(got), len(sent))
+}
+
+// lineDiff writes a minimal "-old"/"+new" line diff of a and b to w.
+func lineDiff(w io.Writer, a, b []byte) {
+	x, y := lines(a), lines(b)
+	if len(x)*len(y) > 4_000_000 {
+		fmt.Fprintln(w, "(too many lines to diff)")
+		return
+	}
+	// lcs[i][j] is the LCS length of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if bytes.Equal(x[i], y[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	show := func(prefix string, line []byte) {
+		fmt.Fprintf(w, "%s%s\n", prefix, bytes.TrimRight(line, "\r\n"))
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && bytes.Equal(x[i], y[j]):
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			show("-", x[i])
+			i++
+		default:
+			show("+", y[j])
+			j++
+		}
+	}
+}
+
+// termCap describes what a kind of terminal is known to handle.
+type termCap struct {
+	maxSeq   int // longest escape sequence passed through intact; 0 if no known limit
+	maxBytes int // conservative copy size for -auto-max; 0 means autoMaxDefault
+}
+
+// termCaps is keyed by terminalKind.
+var termCaps = map[string]termCap{
+	"screen":      {maxSeq: 768},
+	"xterm-kitty": {maxBytes: 1 << 20},
+}
+
+// autoMaxDefault is the -auto-max size for terminals without a known one:
+// it keeps the OSC52 sequence near 100 KB, which most terminals accept.
+const autoMaxDefault = 74994
+
+// screenChunk is the base64 piece size per DCS string in screen's chunked form.
+const screenChunk = 76
+
+// terminalKind names the multiplexer we're under, or falls back to TERM.
+// tmux often sets TERM=screen*, so the multiplexers are told apart by their
+// own environment variables.
+func terminalKind() string {
+	switch {
+	case getenv("TMUX") != "":
+		return "tmux"
+	case getenv("STY") != "":
+		return "screen"
+	}
+	return getenv("TERM")
+}
+
+// tmuxWriter wraps each write in tmux's passthrough escape, so tmux hands it
+// to the outer terminal untouched (needs allow-passthrough on in tmux 3.3+).
+type tmuxWriter struct {
+	w io.Writer
+}
+
+func (t *tmuxWriter) Write(p []byte) (int, error) {
+	wrapped := "\033Ptmux;" + strings.ReplaceAll(string(p), "\033", "\033\033") + "\033\\"
+	if _, err := io.WriteString(t.w, wrapped); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setTmuxBuffer puts data in tmux's paste buffer.
+func setTmuxBuffer(data []byte) error {
+	cmd := exec.Command("tmux", "load-buffer", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tmux load-buffer: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// rawCapForBase64 is the most raw bytes whose base64 encoding fits in n
+// bytes: every 3 raw bytes become 4, padding included.
+func rawCapForBase64(n int) int {
+	return n / 4 * 3
+}
+
+// osc52Len is the length of the single OSC52 sequence carrying n raw bytes.
+func osc52Len(n int) int {
+	return len("\033]52;c;") + base64.StdEncoding.EncodedLen(n) + len("\033\\")
+}
+
+// recordWriter passes writes through to w and appends each one to rec,
+// preceded by a timestamp comment line unless raw.
+type recordWriter struct {
+	w   io.Writer
+	rec io.Writer
+	raw bool
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if r.raw {
+		_, err = r.rec.Write(p)
+	} else {
+		_, err = fmt.Fprintf(r.rec, "# rcp %s, %d bytes\n%s\n", now().Format(time.RFC3339), len(p), p)
+	}
+	if err != nil {
+		return n, fmt.Errorf("-record: %v", err)
+	}
+	return n, nil
+}
+
+// clipWriter collects writes and sends them as one OSC52 copy on Close. Writes
+// that would take it past buf.max fail with the too-large error, so callers
+// can io.Copy into it and stop early.
+type clipWriter struct {
+	out    io.Writer
+	sel    string
+	maxSeq int
+	buf    limitedBuffer
+	closed bool
+	pieces int // sequences sent by Close
+}
+
+func (w *clipWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write after close")
+	}
+	return w.buf.Write(p)
+}
+
+// Close sends what was written. Closing again does nothing.
+func (w *clipWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	var err error
+	w.pieces, err = sendOSC52(w.out, w.sel, w.buf.buf.Bytes(), w.maxSeq)
+	return err
+}
+
+// sendOSC52 writes data to w for selection sel, chunking it when it is longer
+// than maxSeq (or the terminal's known limit if maxSeq is 0) and the terminal
+// has a chunked form. It returns the number of sequences written.
+func sendOSC52(w io.Writer, sel string, data []byte, maxSeq int) (int, error) {
+	if maxSeq <= 0 {
+		maxSeq = termCaps[terminalKind()].maxSeq
+	}
+	chunked := maxSeq > 0 && osc52Len(len(data)) > maxSeq
+	if chunked && terminalKind() != "screen" {
+		fmt.Fprintf(stderr, "rcp: sequence is %d bytes (over %d) but %s has no chunked form; sending it whole\n",
+			osc52Len(len(data)), maxSeq, terminalKind())
+		chunked = false
+	}
+	return writeOSC52(w, sel, data, chunked)
+}
+
+// writeOSC52 emits data as an OSC52 write to selection sel. When chunked, it uses
+// screen's form: the sequence is split across DCS strings that screen
+// concatenates before passing it to the outer terminal. It returns the number
+// of sequences written.
+func writeOSC52(w io.Writer, sel string, data []byte, chunked bool) (int, error) {
+	b64 := base64.StdEncoding.EncodeToString(data)
+	if !chunked {
+		_, err := fmt.Fprintf(w, "\033]52;%s;%s\033\\", sel, b64)
+		return 1, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\033P\033]52;" + sel + ";")
+	pieces := 1
+	for i := 0; i < len(b64); i += screenChunk {
+		if i > 0 {
+			buf.WriteString("\033\\\033P")
+			pieces++
+		}
+		buf.WriteString(b64[i:min(i+screenChunk, len(b64))])
+	}
+	buf.WriteString("\a\033\\")
+	_, err := w.Write(buf.Bytes())
+	return pieces, err
+}
+
+// clearOSC52 returns an OSC52 write of "!" to selection sel. "!" is not
+// base64, and terminals take it as a request to clear the selection.
+func clearOSC52(sel string) string {
+	return "\033]52;" + sel + ";!\033\\"
+}
+
+// kittyChunk is the default base64 piece size for -chunk-resume on kitty.
+const kittyChunk = 4096
+
+// writeKittyOSC52 sends data to selection sel as a series of OSC52 writes of
+// at most chunk base64 bytes each, framed for kitty, which concatenates
+// consecutive writes to the same selection:
+//
+//   - start: a write of "!" (not base64), which clears the selection so the
+//     chunks that follow build it up from empty
+//   - continue: one write per chunk, each a whole multiple of 4 base64 bytes
+//   - end: the last chunk; nothing is sent after it
+//
+// If a write fails or interrupt fires before the last chunk, it tries to send
+// the clear again so the receiver isn't left holding a partial copy, and
+// returns an error. It returns the number of sequences written.
+func writeKittyOSC52(w io.Writer, sel string, data []byte, chunk int, interrupt <-chan os.Signal) (int, error) {
+	clear := clearOSC52(sel)
+	chunk = max(4, chunk/4*4)
+	b64 := base64.StdEncoding.EncodeToString(data)
+	if _, err := io.WriteString(w, clear); err != nil {
+		return 0, err
+	}
+	pieces := 1
+	for i := 0; i < len(b64); i += chunk {
+		select {
+		case sig := <-interrupt:
+			io.WriteString(w, clear)
+			return pieces, fmt.Errorf("%v during a chunked send; cleared the partial copy", sig)
+		default:
+		}
+		if _, err := fmt.Fprintf(w, "\033]52;%s;%s\033\\", sel, b64[i:min(i+chunk, len(b64))]); err != nil {
+			io.WriteString(w, clear)
+			return pieces, err
+		}
+		pieces++
+	}
+	return pieces, nil
+}
+
+// defaultStatusFormat is the -status-format template giving rcp's usual
+// "Sent ..." line.
+const defaultStatusFormat = `Sent {{.Bytes}} bytes via OSC52{{if gt .Chunks 1}} ({{.Chunks}} chunks){{end}}`
+
+// statusInfo is what -status-format templates can use.
+type statusInfo struct {
+	Bytes     int           // bytes copied
+	Chunks    int           // OSC52 sequences sent
+	Mode      string        // file, stdin, exec, bridge, inputs, calc, map or swap
+	Selection string        // OSC52 selection written, e.g. "c"
+	Wrap      string        // "tmux" (passthrough), "screen" (DCS chunks), "kitty" (framed chunks) or ""
+	Duration  time.Duration // time since rcp started
+}
+
+// exitOutsideRoot is the exit status when -root rejects a file.
+const exitOutsideRoot = 3
+
+// exitMaxRuntime is the exit status when -max-runtime runs out, the same as
+// timeout(1).
+const exitMaxRuntime = 124
+
+// errMaxRuntime is what reads give once -max-runtime has run out.
+var errMaxRuntime = errors.New("-max-runtime reached")
+
+// ctxReader is a reader that gives errMaxRuntime once ctx is done, even if
+// the read underneath is still blocked. That read is abandoned; its data, if
+// it ever comes, goes into a buffer of its own.
+type ctxReader struct {
+	ctx     context.Context
+	r       io.Reader
+	pending chan ctxRead
+}
+
+type ctxRead struct {
+	b   []byte
+	err error
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if c.pending == nil {
+		buf, ch := make([]byte, len(p)), make(chan ctxRead, 1)
+		go func() {
+			n, err := c.r.Read(buf)
+			ch <- ctxRead{buf[:n], err}
+		}()
+		c.pending = ch
+	}
+	select {
+	case <-c.ctx.Done():
+		return 0, errMaxRuntime
+	case res := <-c.pending:
+		c.pending = nil
+		return copy(p, res.b), res.err
+	}
+}
+
+// shellCommand returns a bash -c command that is killed when ctx is done.
+// With group it runs in its own process group where the system has them, so
+// whatever bash started is killed too.
+func shellCommand(ctx context.Context, script string, group bool) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "bash", "-c", script)
+	if group {
+		killGroup(cmd)
+	}
+	return cmd
+}
+
+// withinRoot reports whether path, with symlinks and ".." resolved, lies
+// inside root.
+func withinRoot(root, path string) (bool, error) {
+	r, err := filepath.Abs(root)
+	if err == nil {
+		r, err = filepath.EvalSymlinks(r)
+	}
+	if err != nil {
+		return false, err
+	}
+	p, err := filepath.Abs(path)
+	if err == nil {
+		p, err = filepath.EvalSymlinks(p)
+	}
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(r, p)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// joinContinuations joins lines that end in a backslash with the next line,
+// dropping the backslash and line ending as the shell does. A line ending in
+// an even run of backslashes ends with escaped backslashes and is left alone.
+func joinContinuations(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range lines(data) {
+		body, eol := splitEOL(line)
+		n := len(body) - len(bytes.TrimRight(body, "\\"))
+		if len(eol) > 0 && n%2 == 1 {
+			out.Write(body[:len(body)-1])
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// unwrapLines joins each line that starts with a space or tab onto the line
+// before it, dropping the line break between them; with space, the break
+// and the leading whitespace become a single space. Blank lines are never
+// joined, and nothing is joined onto one.
+func unwrapLines(data []byte, space bool) []byte {
+	var out bytes.Buffer
+	var pendingEOL []byte
+	prevBlank := true
+	for _, line := range lines(data) {
+		body, eol := splitEOL(line)
+		blank := len(bytes.TrimSpace(body)) == 0
+		if !blank && !prevBlank && (body[0] == ' ' || body[0] == '\t') {
+			if space {
+				body = append([]byte(" "), bytes.TrimLeft(body, " \t")...)
+			}
+		} else {
+			out.Write(pendingEOL)
+		}
+		out.Write(body)
+		pendingEOL = eol
+		prevBlank = blank
+	}
+	out.Write(pendingEOL)
+	return out.Bytes()
+}
+
+// rtrimLines removes trailing spaces and tabs from each line of data.
+func rtrimLines(data []byte) []byte {
+	var out bytes.Buffer
+	for _, line := range lines(data) {
+		body, eol := splitEOL(line)
+		out.Write(bytes.TrimRight(body, " \t"))
+		out.Write(eol)
+	}
+	return out.Bytes()
+}
+
+// stripQuotes removes one layer of matching single or double quotes around
+// data, or around each line with perLine. Line endings stay where they are,
+// and anything not quoted on both ends is left alone.
+func stripQuotes(data []byte, perLine bool) []byte {
+	unquote := func(line []byte) []byte {
+		body, eol := splitEOL(line)
+		if len(body) >= 2 && body[0] == body[len(body)-1] && (body[0] == '"' || body[0] == '\'') {
+			return append(slices.Clone(body[1:len(body)-1]), eol...)
+		}
+		return line
+	}
+	if !perLine {
+		return unquote(data)
+	}
+	var out bytes.Buffer
+	for _, line := range lines(data) {
+		out.Write(unquote(line))
+	}
+	return out.Bytes()
+}
+
+// collapseBlank squeezes runs of blank (or whitespace-only) lines into one.
+func collapseBlank(data []byte) []byte {
+	var out bytes.Buffer
+	prevBlank := false
+	for _, line := range lines(data) {
+		blank := len(bytes.TrimSpace(line)) == 0
+		if blank && prevBlank {
+			continue
+		}
+		out.Write(line)
+		prevBlank = blank
+	}
+	return out.Bytes()
+}
+
+// tidy cleans up code for sharing. In order, it removes trailing spaces and
+// tabs (rtrimLines), squeezes blank lines (collapseBlank), removes the
+// indentation all non-blank lines share, and ends the content with exactly
+// one line ending. Content that is all whitespace comes out empty.
+func tidy(data []byte) []byte {
+	ls := lines(collapseBlank(rtrimLines(data)))
+	var indent []byte
+	seen := false
+	for _, line := range ls {
+		body, _ := splitEOL(line)
+		if len(body) == 0 {
+			continue
+		}
+		ws := body[:len(body)-len(bytes.TrimLeft(body, " \t"))]
+		if !seen {
+			indent, seen = ws, true
+			continue
+		}
+		n := 0
+		for n < len(indent) && n < len(ws) && indent[n] == ws[n] {
+			n++
+		}
+		indent = indent[:n]
+	}
+	var out bytes.Buffer
+	eol := []byte("\n")
+	for _, line := range ls {
+		body, e := splitEOL(line)
+		out.Write(bytes.TrimPrefix(body, indent))
+		out.Write(e)
+		if len(e) > 0 {
+			eol = e
+		}
+	}
+	b := bytes.TrimRight(out.Bytes(), "\r\n")
+	if len(b) == 0 {
+		return nil
+	}
+	return append(b, eol...)
+}
+
+// isPathByte reports whether c can be part of a path component.
+func isPathByte(c byte) bool {
+	return c == '/' || c == '.' || c == '-' || c == '_' ||
+		c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// interpRe matches what -interp rewrites: "$$" and "${name}".
+var interpRe = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// interpolate replaces ${name} in data with vars[name] and "$$" with "$".
+// Unknown names are left as they are, or reported when strict.
+func interpolate(data []byte, vars map[string]string, strict bool) ([]byte, error) {
+	var unknown []string
+	out := interpRe.ReplaceAllFunc(data, func(m []byte) []byte {
+		if string(m) == "$$" {
+			return []byte("$")
+		}
+		name := string(m[2 : len(m)-1])
+		v, ok := vars[name]
+		if !ok {
+			if !slices.Contains(unknown, name) {
+				unknown = append(unknown, name)
+			}
+			return m
+		}
+		return []byte(v)
+	})
+	if strict && len(unknown) > 0 {
+		return nil, fmt.Errorf("undefined: %s", strings.Join(unknown, ", "))
+	}
+	return out, nil
+}
+
+// urlRe matches http, https and ftp URLs with a plausible host. Trailing
+// punctuation is trimmed afterwards by extractURLs.
+var urlRe = regexp.MustCompile(`\b(?:https?|ftp)://[A-Za-z0-9](?:[A-Za-z0-9.-]*[A-Za-z0-9])?(?::[0-9]+)?(?:[/?#][^\s<>"'\x60]*)?`)
+
+// extractURLs returns the URLs in data, one per line, in the order they first
+// appear; with unique, repeats are dropped. Sentence punctuation after a URL
+// is not part of it, and neither is a ")" that doesn't close a "(" inside it.
+func extractURLs(data []byte, unique bool) []byte {
+	var out bytes.Buffer
+	seen := map[string]bool{}
+	for _, m := range urlRe.FindAll(data, -1) {
+		for len(m) > 0 {
+			last := m[len(m)-1]
+			if strings.IndexByte(".,;:!?'\"]}", last) >= 0 ||
+				last == ')' && bytes.Count(m, []byte("(")) < bytes.Count(m, []byte(")")) {
+				m = m[:len(m)-1]
+				continue
+			}
+			break
+		}
+		if unique && seen[string(m)] {
+			continue
+		}
+		seen[string(m)] = true
+		out.Write(m)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// maskMatches replaces every match of re in data with asterisks of the same
+// length in runes. Matches of 8 runes or more keep their first and last two
+// runes, so a token's shape stays recognizable without giving it away.
+func maskMatches(data []byte, re *regexp.Regexp) []byte {
+	return re.ReplaceAllFunc(data, func(m []byte) []byte {
+		r := []rune(string(m))
+		keep := 0
+		if len(r) >= 8 {
+			keep = 2
+		}
+		for i := keep; i < len(r)-keep; i++ {
+			r[i] = '*'
+		}
+		return []byte(string(r))
+	})
+}
+
+var homeVarRe = regexp.MustCompile(`\$HOME\b`)
+
+// tildeHome replaces home with "~" wherever it appears as a whole path
+// prefix: not glued to a preceding path, and followed by "/" or a non-path
+// byte (so /home/al leaves /home/alice alone). With envToo, $HOME and
+// ${HOME} become "~" as well.
+func tildeHome(data []byte, home string, envToo bool) []byte {
+	h := []byte(strings.TrimSuffix(home, "/"))
+	if len(h) == 0 {
+		return data
+	}
+	var out bytes.Buffer
+	for {
+		i := bytes.Index(data, h)
+		if i < 0 {
+			out.Write(data)
+			break
+		}
+		end := i + len(h)
+		before := i == 0 || !isPathByte(data[i-1])
+		after := end == len(data) || data[end] == '/' || !isPathByte(data[end])
+		out.Write(data[:i])
+		if before && after {
+			out.WriteByte('~')
+		} else {
+			out.Write(h)
+		}
+		data = data[end:]
+	}
+	res := out.Bytes()
+	if envToo {
+		res = bytes.ReplaceAll(res, []byte("${HOME}"), []byte("~"))
+		res = homeVarRe.ReplaceAll(res, []byte("~"))
+	}
+	return res
+}
+
+// sortWarnBytes is the content size past which sorting warns about memory.
+const sortWarnBytes = 10 << 20
+
+// leadingNumber parses the number at the start of s, ignoring leading
+// blanks: an optional "-", digits and at most one ".", so "10.0.0.2" is 10.0
+// as with sort -n. Lines without one sort as 0.
+func leadingNumber(s []byte) float64 {
+	s = bytes.TrimLeft(s, " \t")
+	end, dot := 0, false
+	if end < len(s) && s[end] == '-' {
+		end++
+	}
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == '.' && !dot) {
+		dot = dot || s[end] == '.'
+		end++
+	}
+	n, err := strconv.ParseFloat(string(s[:end]), 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// sortLines sorts and/or de-duplicates the lines of data. Lines are compared
+// without their endings and keep their own "\n" or "\r\n". A line that had
+// no ending (the last one) gets the first ending in data if it moves up, and
+// the output ends without one only if data did.
+func sortLines(data []byte, sorted, numeric, reverse, uniq bool) []byte {
+	type line struct{ body, eol []byte }
+	var ls []line
+	nl := []byte("\n")
+	for _, l := range lines(data) {
+		body, eol := splitEOL(l)
+		if len(ls) == 0 && len(eol) > 0 {
+			nl = eol
+		}
+		ls = append(ls, line{body, eol})
+	}
+	if sorted {
+		slices.SortStableFunc(ls, func(a, b line) int {
+			c := 0
+			if numeric {
+				na, nb := leadingNumber(a.body), leadingNumber(b.body)
+				switch {
+				case na < nb:
+					c = -1
+				case na > nb:
+					c = 1
+				}
+			}
+			if c == 0 {
+				c = bytes.Compare(a.body, b.body)
+			}
+			if reverse {
+				c = -c
+			}
+			return c
+		})
+	}
+	if uniq {
+		ls = slices.CompactFunc(ls, func(a, b line) bool { return bytes.Equal(a.body, b.body) })
+	}
+	var out bytes.Buffer
+	for i, l := range ls {
+		out.Write(l.body)
+		switch {
+		case i == len(ls)-1 && !bytes.HasSuffix(data, []byte("\n")):
+		case len(l.eol) == 0:
+			out.Write(nl)
+		default:
+			out.Write(l.eol)
+		}
+	}
+	return out.Bytes()
+}
+
+// validSelection reports whether sel is an OSC52 selection name.
+func validSelection(sel string) bool {
+	return len(sel) == 1 && strings.Contains("cpsq01234567", sel)
+}
+
+// transformFlags are the flags that rewrite content before it is copied.
+var transformFlags = []string{"ts", "interp", "urls", "mask", "strip-prompt", "strip-comments", "join-continuations", "unwrap", "rtrim-lines", "strip-quotes", "collapse-blank", "tidy", "tilde", "sort", "sort-numeric", "reverse", "uniq", "escape"}
+
+// plainDisables are the content-changing flags that -plain switches off.
+var plainDisables = append([]string{"data-uri", "pretty"}, transformFlags...)
+
+// flagConflicts lists pairs of flags that can't be used together.
+var flagConflicts = [][2]string{
+	{"c", "e"},
+	{"bridge", "c"},
+	{"bridge", "e"},
+	{"img", "c"},
+	{"img", "e"},
+	{"img", "validate"},
+	{"img", "data-uri"},
+	{"img", "host"},
+	{"data-uri", "host"},
+	{"data-uri", "c"},
+	{"data-uri", "e"},
+	{"data-uri", "validate"},
+	{"e-dry", "e-sep"},
+	{"e-dry", "retries"},
+	{"e-dry", "e-stream"},
+	{"e-stream", "retries"},
+	{"resume", "c"},
+	{"resume", "e"},
+	{"resume", "bridge"},
+	{"inputs", "c"},
+	{"inputs", "e"},
+	{"inputs", "bridge"},
+	{"inputs", "resume"},
+	{"pass", "e"},
+	{"pass", "bridge"},
+	{"pass", "resume"},
+	{"resume", "ts"},
+	{"grep", "plain"},
+	{"jq", "plain"},
+	{"decompress", "plain"},
+	{"base", "plain"},
+	{"q", "status"},
+	{"q", "status-format"},
+	{"status-format", "promote"},
+	{"status-format", "peek"},
+}
+
+// flagRequires maps a flag to another flag it only makes sense with.
+var flagRequires = map[string]string{
+	"pretty":          "validate",
+	"bridge-from":     "bridge",
+	"ts-format":       "ts",
+	"e-sep":           "e",
+	"e-stream":        "e",
+	"stream-interval": "e-stream",
+	"tilde-env":       "tilde",
+	"urls-unique":     "urls",
+	"grep-v":          "grep",
+	"per-line":        "strip-quotes",
+	"var":             "interp",
+	"unwrap-space":    "unwrap",
+	"interp-strict":   "interp",
+	"force":           "cooldown",
+	"prompt-regex":    "strip-prompt",
+	"raw":             "record",
+	"clean-env":       "e",
+	"keep-env":        "clean-env",
+	"e-dry":           "e",
+	"paste-format":    "paste-service",
+	"paste-field":     "paste-service",
+	"headers":         "inputs",
+	"headers-size":    "headers",
+	"host-user":       "host",
+	"retries":         "e",
+	"retry-delay":     "retries",
+	"quiet-interval":  "follow",
+}
+
+// flagChoices lists the accepted values of enumerated flags.
+var flagChoices = map[string][]string{
+	"validate":       {"json", "yaml"},
+	"strip-comments": {"hash", "slash", "semicolon"},
+	"escape":         {"go", "json", "shell", "python"},
+	"bridge-from":    {"clipboard", "primary"},
+	"paste-format":   {"raw", "form", "json"},
+	"on-empty":       {"refuse", "clear", "allow"},
+}
+
+// conflictPairs returns flagConflicts plus the pairs generated for the mode
+// flags, which rule out most others.
+func conflictPairs() [][2]string {
+	conflicts := slices.Clone(flagConflicts)
+	for _, t := range transformFlags {
+		conflicts = append(conflicts, [2]string{"img", t}, [2]string{"data-uri", t}, [2]string{"detect", t})
+	}
+	for _, f := range []string{"c", "img", "data-uri", "validate", "diff-clipboard", "pass", "resume"} {
+		conflicts = append(conflicts, [2]string{"detect", f})
+	}
+	for _, f := range []string{"map", "swap-selection", "follow", "e-stream", "detect"} {
+		conflicts = append(conflicts, [2]string{"verify", f}, [2]string{"paste-service", f}, [2]string{"notify", f}, [2]string{"cooldown", f}, [2]string{"both-tmux", f}, [2]string{"chunk-resume", f}, [2]string{"on-empty", f})
+	}
+	for _, f := range []string{"img", "data-uri", "detect", "validate", "diff-clipboard"} {
+		conflicts = append(conflicts, [2]string{"e-stream", f})
+	}
+	for _, f := range []string{"c", "e", "bridge", "inputs", "resume", "img", "data-uri", "detect", "validate", "diff-clipboard"} {
+		conflicts = append(conflicts, [2]string{"follow", f})
+	}
+	for _, f := range []string{"c", "e", "bridge", "inputs", "map", "resume", "follow", "img", "data-uri", "detect"} {
+		conflicts = append(conflicts, [2]string{"jq", f}, [2]string{"base", f})
+	}
+	for _, f := range []string{"c", "e", "map", "swap-selection", "promote", "calc", "resume", "follow", "e-stream", "img", "data-uri"} {
+		conflicts = append(conflicts, [2]string{"decompress", f})
+	}
+	for _, f := range []string{"map", "swap-selection", "promote", "peek", "follow", "e-stream", "img", "data-uri", "detect", "plain"} {
+		conflicts = append(conflicts, [2]string{"filter", f})
+	}
+	// -map copies each file as-is, so it only combines with emission flags.
+	for _, f := range append([]string{"c", "e", "bridge", "inputs", "resume", "pass", "follow", "host", "img", "data-uri", "detect", "validate", "diff-clipboard"}, transformFlags...) {
+		conflicts = append(conflicts, [2]string{"map", f})
+	}
+	// -promote only moves PRIMARY to CLIPBOARD on the local display, and
+	// -peek only reads the clipboard.
+	for _, f := range append([]string{"c", "e", "bridge", "inputs", "map", "calc", "swap-selection", "resume", "pass", "follow", "host", "img", "data-uri", "detect", "validate", "diff-clipboard", "grep", "jq", "base", "record", "both-tmux", "chunk-resume", "verify", "paste-service", "notify", "cooldown", "on-empty"}, transformFlags...) {
+		conflicts = append(conflicts, [2]string{"promote", f}, [2]string{"peek", f})
+	}
+	conflicts = append(conflicts, [2]string{"peek", "promote"}, [2]string{"auto-max", "detect"}, [2]string{"auto-max", "peek"}, [2]string{"auto-max", "promote"})
+	// -swap-selection moves content between selections untouched, like -map.
+	for _, f := range append([]string{"c", "e", "bridge", "inputs", "map", "calc", "resume", "pass", "follow", "host", "img", "data-uri", "detect", "validate", "diff-clipboard", "grep", "jq", "base"}, transformFlags...) {
+		conflicts = append(conflicts, [2]string{"swap-selection", f})
+	}
+	for _, f := range []string{"c", "e", "bridge", "inputs", "map", "resume", "pass", "follow", "grep", "jq", "base", "img", "data-uri"} {
+		conflicts = append(conflicts, [2]string{"calc", f})
+	}
+	return conflicts
+}
+
+// preflight checks the parsed flags and arguments as a whole and returns one
+// message per problem found.
+func preflight(fs *flag.FlagSet, args []string) []string {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		// -c=false and the like leave a flag off.
+		set[f.Name] = !isBoolFlag(f) || f.Value.String() == "true"
+	})
+	val := func(name string) string { return fs.Lookup(name).Value.String() }
+	if set["plain"] {
+		off := slices.Clone(plainDisables)
+		for _, name := range plainDisables {
+			delete(set, name)
+		}
+		// The flags that only tune a disabled one (-var, -per-line and so on)
+		// are off too.
+		for changed := true; changed; {
+			changed = false
+			for name, need := range flagRequires {
+				if set[name] && slices.Contains(off, need) {
+					delete(set, name)
+					off = append(off, name)
+					changed = true
+				}
+			}
+		}
+	}
+
+	var errs []string
+	for _, c := range conflictPairs() {
+		if set[c[0]] && set[c[1]] {
+			errs = append(errs, fmt.Sprintf("-%s can't be used with -%s", c[0], c[1]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(flagRequires)) {
+		if need := flagRequires[name]; set[name] && !set[need] {
+			errs = append(errs, fmt.Sprintf("-%s requires -%s", name, need))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(flagChoices)) {
+		choices := flagChoices[name]
+		if v := val(name); set[name] && !slices.Contains(choices, v) {
+			errs = append(errs, fmt.Sprintf("-%s: unknown value %q (%s)", name, v, strings.Join(choices, ", ")))
+		}
+	}
+
+	for _, mode := range []string{"bridge", "inputs", "map", "calc", "swap-selection", "promote", "peek"} {
+		if set[mode] && len(args) > 0 {
+			errs = append(errs, "-"+mode+" can't be used with a file argument")
+		}
+	}
+	if set["grep"] && (set["e"] || set["bridge"] || set["inputs"] || set["map"] || len(args) > 0 && args[0] != "-") {
+		errs = append(errs, "-grep only works on stdin")
+	}
+	if set["grep"] {
+		if _, err := regexp.Compile(val("grep")); err != nil {
+			errs = append(errs, fmt.Sprintf("-grep: %v", err))
+		}
+	}
+	if set["var"] {
+		for _, kv := range *fs.Lookup("var").Value.(*stringList) {
+			if k, _, ok := strings.Cut(kv, "="); !ok || interpRe.FindString("${"+k+"}") != "${"+k+"}" {
+				errs = append(errs, fmt.Sprintf("-var: bad definition %q (want NAME=VALUE, NAME made of letters, digits and _)", kv))
+			}
+		}
+	}
+	if set["pretty"] && set["validate"] && val("validate") != "json" {
+		errs = append(errs, "-pretty only works with -validate json")
+	}
+	if set["max-base64-bytes"] {
+		if n, _ := strconv.Atoi(val("max-base64-bytes")); n < 4 {
+			errs = append(errs, "-max-base64-bytes must be at least 4")
+		}
+	}
+	if set["status-format"] {
+		t, err := template.New("status").Parse(val("status-format"))
+		if err == nil {
+			err = t.Execute(io.Discard, statusInfo{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("-status-format: %v", err))
+		}
+	}
+	if set["mask"] {
+		for _, expr := range *fs.Lookup("mask").Value.(*stringList) {
+			if _, err := regexp.Compile(expr); err != nil {
+				errs = append(errs, fmt.Sprintf("-mask: %v", err))
+			}
+		}
+	}
+	if set["resume"] && !set["e"] && !set["bridge"] && !set["inputs"] && (len(args) == 0 || args[0] == "-") {
+		errs = append(errs, "-resume only works with a filename (rcp -resume <file>)")
+	}
+	if set["map"] {
+		for _, item := range strings.Split(val("map"), ",") {
+			i := strings.LastIndex(item, ":")
+			if i <= 0 || !validSelection(item[i+1:]) {
+				errs = append(errs, fmt.Sprintf("-map: bad entry %q (want FILE:SEL, SEL one of c, p, s, q, 0-7)", item))
+			}
+		}
+	}
+	if set["swap-selection"] {
+		from, to, ok := strings.Cut(val("swap-selection"), ":")
+		if !ok || !validSelection(from) || !validSelection(to) || from == to {
+			errs = append(errs, fmt.Sprintf("-swap-selection: bad value %q (want FROM:TO, two different selections among c, p, s, q, 0-7)", val("swap-selection")))
+		}
+	}
+	if _, _, ok := parseBases(val("base")); set["base"] && !ok {
+		errs = append(errs, fmt.Sprintf("-base: bad value %q (want FROM:TO, each one of 2, 8, 10, 16)", val("base")))
+	}
+	if set["follow"] && len(args) > 0 && args[0] != "-" {
+		errs = append(errs, "-follow only works with stdin")
+	}
+	if u := val("paste-service"); set["paste-service"] && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		errs = append(errs, "-paste-service: want an http:// or https:// URL, got "+u)
+	}
+	if _, err := regexp.Compile(val("prompt-regex")); set["prompt-regex"] && err != nil {
+		errs = append(errs, fmt.Sprintf("-prompt-regex: %v", err))
+	}
+	if set["c"] && !set["e"] && (len(args) == 0 || args[0] == "-") {
+		errs = append(errs, "-c only works with a filename (rcp -c <file>)")
+	}
+	if root := val("root"); set["root"] {
+		if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+			errs = append(errs, "-root: not a directory: "+root)
+		}
+	}
+	return errs
+}
+
+// stringList is a flag.Value collecting every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// essentialEnv is what -clean-env keeps by default.
+var essentialEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
+// cleanEnv returns the essential variables plus keep, taken from getenv
+// where set to something non-empty.
+func cleanEnv(keep []string) []string {
+	var env []string
+	for _, k := range append(slices.Clone(essentialEnv), keep...) {
+		if v := getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// unescape interprets Go-style backslash escapes (\n, \t, \\, ...) in s,
+// returning s unchanged if it isn't a valid escaped string.
+func unescape(s string) string {
+	u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`)
+	if err != nil {
+		return s
+	}
+	return u
+}
+
+func configPath() (string, error) {
+	dir := getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "rcp", "config"), nil
+}
+
+// splitFlags splits the leading flags of args without parsing them, one
+// group per flag: the flag itself and, for a non-boolean flag given as
+// "-name value", its value. It stops where fs.Parse would, and also returns
+// what is left of args.
+func splitFlags(fs *flag.FlagSet, args []string) (groups [][]string, rest []string) {
+	for len(args) > 0 {
+		a := args[0]
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			break
+		}
+		n := 1
+		name, _, hasV := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if f := fs.Lookup(name); f != nil && !hasV && !isBoolFlag(f) && len(args) > 1 {
+			n = 2
+		}
+		groups, args = append(groups, args[:n]), args[n:]
+	}
+	return groups, args
+}
+
+// flagName returns the name of the flag in arg ("-name" or "--name=value").
+func flagName(arg string) string {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	return name
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// profileName finds the -profile value in args without parsing them, so the
+// profile's flags can be applied before the command line.
+func profileName(fs *flag.FlagSet, args []string) string {
+	groups, _ := splitFlags(fs, args)
+	for _, g := range groups {
+		if flagName(g[0]) != "profile" {
+			continue
+		}
+		if _, v, ok := strings.Cut(g[0], "="); ok {
+			return v
+		}
+		if len(g) > 1 {
+			return g[1]
+		}
+		return ""
+	}
+	return ""
+}
+
+// dropOverridden removes from the profile's flags pargs those that conflict
+// with a flag given in args, so the command line can switch modes a profile
+// picks.
+func dropOverridden(fs *flag.FlagSet, pargs, args []string) []string {
+	cli := map[string]bool{}
+	groups, _ := splitFlags(fs, args)
+	for _, g := range groups {
+		cli[flagName(g[0])] = true
+	}
+	groups, rest := splitFlags(fs, pargs)
+	var kept []string
+	for _, g := range groups {
+		name := flagName(g[0])
+		if !slices.ContainsFunc(conflictPairs(), func(c [2]string) bool {
+			return c[0] == name && cli[c[1]] || c[1] == name && cli[c[0]]
+		}) {
+			kept = append(kept, g...)
+		}
+	}
+	return append(kept, rest...)
+}
+
+// loadProfile returns the flags listed under [name] in the config file.
+// Sections hold whitespace-separated flags over any number of lines; '#'
+// starts a comment.
+func loadProfile(name string) ([]string, error) {
+	p, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	found, in := false, false
+	for n, line := range strings.Split(string(b), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: bad section header %q", p, n+1, line)
+			}
+			in = strings.TrimSpace(line[1:len(line)-1]) == name
+			found = found || in
+			continue
+		}
+		if in {
+			args = append(args, strings.Fields(line)...)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no [%s] profile in %s", name, p)
+	}
+	return args, nil
+}
+
+// resumeState records how far -resume got through a file. Size and ModTime
+// identify the version of the file the offset belongs to.
+type resumeState struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+	Offset  int64 `json:"offset"`
+}
+
+// statePath returns the path of the named file in rcp's state directory.
+func statePath(name string) (string, error) {
+	dir := getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "rcp", name), nil
+}
+
+// lastCopyTime returns when -cooldown last recorded a copy, or the zero time.
+func lastCopyTime() time.Time {
+	if p, err := statePath("last-copy"); err == nil {
+		if b, err := os.ReadFile(p); err == nil {
+			if ns, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+				return time.Unix(0, ns)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func saveLastCopyTime(t time.Time) error {
+	p, err := statePath("last-copy")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p, []byte(strconv.FormatInt(t.UnixNano(), 10)+"\n"), 0o600)
+}
+
+// loadResumeStates reads the saved offsets, keyed by absolute path. A missing
+// or unreadable state file counts as empty.
+func loadResumeStates() map[string]resumeState {
+	states := map[string]resumeState{}
+	if p, err := statePath("resume.json"); err == nil {
+		if b, err := os.ReadFile(p); err == nil {
+			json.Unmarshal(b, &states)
+		}
+	}
+	return states
+}
+
+func saveResumeStates(states map[string]resumeState) error {
+	p, err := statePath("resume.json")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o600)
+}
+
+// readPiece reads the next piece of at most max bytes from f, starting where
+// the saved state for path says to. The piece ends at a newline when there is
+// more to come and it contains one. It returns the piece, its start offset and
+// the state to save once the piece has been sent (nil when f is finished).
+func readPiece(f *os.File, path string, max int) ([]byte, int64, *resumeState, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	st := resumeState{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	if saved, ok := loadResumeStates()[path]; ok {
+		if saved.Size == st.Size && saved.ModTime == st.ModTime {
+			st.Offset = saved.Offset
+		} else {
+			fmt.Fprintf(stderr, "rcp: %s changed since the last -resume; starting over\n", path)
+		}
+	}
+	if _, err := f.Seek(st.Offset, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+	piece := make([]byte, max)
+	n, err := io.ReadFull(f, piece)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, nil, err
+	}
+	piece = piece[:n]
+	start := st.Offset
+	if start+int64(n) >= st.Size {
+		return piece, start, nil, nil
+	}
+	if i := bytes.LastIndexByte(piece, '\n'); i >= 0 {
+		piece = piece[:i+1]
+	}
+	st.Offset = start + int64(len(piece))
+	return piece, start, &st, nil
+}
+
+func main() {
+	var t io.Writer
+	if f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		t = f
+	}
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, t, os.Getenv))
+}
+
+// run is rcp's whole command line: it parses args, does the work, and
+// returns the exit status. The OSC52 sequence goes to outw (or ttyw with
+// -pass), status and errors to errw; ttyw may be nil when there is no
+// terminal, and clipboard reads over OSC52 need it to be an io.Reader too.
+// env replaces os.Getenv. It sets the package-level streams, so
+// only one run can be active at a time.
+func run(args []string, in io.Reader, outw, errw, ttyw io.Writer, env func(string) string) (code int) {
+	stdin, stdout, stderr, tty, getenv = in, outw, errw, ttyw, env
+	defer func() {
+		if r := recover(); r != nil {
+			c, ok := r.(exitCode)
+			if !ok {
+				panic(r)
+			}
+			code = int(c)
+		}
+	}()
+
+	start := now()
+	fs := flag.NewFlagSet("rcp", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	withCmd := fs.Bool("c", false, "prepend `cat <file>` before file contents")
+	execCmd := fs.String("e", "", "run command via bash -c and prepend the command")
+	host := fs.Bool("host", false, "start the copy with a header naming this host")
+	hostUser := fs.Bool("host-user", false, "include the current user in the -host header")
+	decompress := fs.Bool("decompress", false, "gunzip the input first if it is gzip-compressed")
+	onEmpty := fs.String("on-empty", "refuse", "what to do when there is nothing to copy: refuse, clear, or allow")
+	jq := fs.String("jq", "", "parse the input as JSON and copy the value at this dotted path")
+	filter := fs.String("filter", "", "pipe the content through this command (via bash -c) and copy its output")
+	base := fs.String("base", "", "copy the input number converted between bases, e.g. 16:10")
+	validate := fs.String("validate", "", "refuse to copy unless content parses as this format (json, yaml)")
+	pretty := fs.Bool("pretty", false, "pretty-print content checked with -validate")
+	grep := fs.String("grep", "", "copy only the stdin lines matching this regexp")
+	grepV := fs.Bool("grep-v", false, "with -grep, copy the lines that don't match instead")
+	interp := fs.Bool("interp", false, "replace ${name} in the content with -var values")
+	var varList stringList
+	fs.Var(&varList, "var", "with -interp, define name=value (repeatable)")
+	interpStrict := fs.Bool("interp-strict", false, "with -interp, refuse to copy if a ${name} has no -var")
+	urls := fs.Bool("urls", false, "copy only the URLs found in the input, one per line")
+	urlsUnique := fs.Bool("urls-unique", true, "with -urls, drop repeated URLs")
+	var masks stringList
+	fs.Var(&masks, "mask", "hide all but the ends of every match of this regexp (repeatable)")
+	stripPromptFlag := fs.Bool("strip-prompt", false, "remove leading shell prompts from each line")
+	promptRegex := fs.String("prompt-regex", defaultPromptRegex, "prompt pattern for -strip-prompt")
+	stripStyle := fs.String("strip-comments", "", "remove comments of this style (hash, slash, semicolon)")
+	joinCont := fs.Bool("join-continuations", false, "join lines ending in a backslash with the next one")
+	unwrap := fs.Bool("unwrap", false, "join lines starting with whitespace onto the previous line")
+	unwrapSpace := fs.Bool("unwrap-space", false, "with -unwrap, join with a single space instead of the indentation")
+	rtrim := fs.Bool("rtrim-lines", false, "remove trailing whitespace from each line")
+	stripQuotesFlag := fs.Bool("strip-quotes", false, "remove one layer of matching quotes around the content")
+	perLine := fs.Bool("per-line", false, "with -strip-quotes, unquote each line instead")
+	collapse := fs.Bool("collapse-blank", false, "squeeze runs of blank lines into one")
+	tidyFlag := fs.Bool("tidy", false, "clean up code: rtrim lines, collapse blanks, dedent, one trailing newline")
+	tilde := fs.Bool("tilde", false, "replace the home directory with ~")
+	tildeEnv := fs.Bool("tilde-env", false, "with -tilde, also replace $HOME with ~")
+	sortFlag := fs.Bool("sort", false, "sort lines")
+	sortNumeric := fs.Bool("sort-numeric", false, "sort lines by leading number")
+	reverse := fs.Bool("reverse", false, "reverse the sort order")
+	uniq := fs.Bool("uniq", false, "drop adjacent duplicate lines")
+	plain := fs.Bool("plain", false, "copy byte-for-byte: ignore every transform flag")
+	escape := fs.String("escape", "", "copy the content as a string literal for this language (go, json, shell, python)")
+	execSep := fs.String("e-sep", `\n`, "separator between the -e command and its output")
+	inputs := fs.String("inputs", "", "comma-separated files to concatenate (LABEL=PATH to label one)")
+	mapSpec := fs.String("map", "", "send files to selections: FILE:SEL,...")
+	execDry := fs.Bool("e-dry", false, "copy only the -e command, without running it")
+	cleanEnvFlag := fs.Bool("clean-env", false, "run -e with only essential environment variables")
+	var keepEnv stringList
+	fs.Var(&keepEnv, "keep-env", "also pass this variable with -clean-env (repeatable)")
+	execStream := fs.Bool("e-stream", false, "with -e, re-copy the output as it arrives")
+	streamInterval := fs.Duration("stream-interval", time.Second, "how often -e-stream re-copies at most")
+	retries := fs.Int("retries", 0, "re-run a failing -e command up to this many times")
+	retryDelay := fs.Duration("retry-delay", time.Second, "wait between -retries attempts")
+	cooldown := fs.Duration("cooldown", 0, "refuse to copy again within this long of the last copy")
+	force := fs.Bool("force", false, "copy even within -cooldown")
+	maxRuntime := fs.Duration("max-runtime", 0, "give up and exit after this long (0: no limit)")
+	headers := fs.Bool("headers", false, "put a ==> PATH <== banner before each -inputs file")
+	headersSize := fs.Bool("headers-size", false, "include each file's size in -headers banners")
+	peek := fs.Bool("peek", false, "show what the clipboard holds, without changing it")
+	promote := fs.Bool("promote", false, "copy the local PRIMARY selection to the local CLIPBOARD (no OSC52)")
+	swapSel := fs.String("swap-selection", "", "copy selection FROM into selection TO (FROM:TO, e.g. p:c)")
+	calcExpr := fs.String("calc", "", "copy the result of this arithmetic expression")
+	bridge := fs.Bool("bridge", false, "copy the local selection (read with xclip/wl-paste/xsel/pbpaste)")
+	bridgeFrom := fs.String("bridge-from", "clipboard", "local selection read by -bridge (clipboard, primary)")
+	ts := fs.Bool("ts", false, "prefix each content line with the time it was read")
+	tsFormat := fs.String("ts-format", "2006-01-02 15:04:05", "time layout for -ts")
+	pass := fs.Bool("pass", false, "pass input through to stdout and send OSC52 to /dev/tty")
+	follow := fs.Bool("follow", false, "keep reading stdin and re-copy the latest tail after each pause")
+	quietInterval := fs.Duration("quiet-interval", time.Second, "pause after new input before -follow re-copies")
+	detect := fs.Bool("detect", false, "report on the input instead of copying it")
+	pasteService := fs.String("paste-service", "", "POST the content here and copy the returned link")
+	pasteFormat := fs.String("paste-format", "raw", "-paste-service request body (raw, form, json)")
+	pasteField := fs.String("paste-field", "content", "form/JSON field for -paste-service content")
+	root := fs.String("root", "", "refuse files outside this directory")
+	resume := fs.Bool("resume", false, "copy the next limit-sized piece of a large file")
+	record := fs.String("record", "", "also append every emitted sequence to this file")
+	recordRaw := fs.Bool("raw", false, "with -record, write only the sequences, no headers")
+	autoMax := fs.Bool("auto-max", false, "probe the terminal and pick the size limit from its known capabilities")
+	chunkResume := fs.Bool("chunk-resume", false, "on kitty, send in framed chunks so an interrupted send leaves no partial copy")
+	bothTmux := fs.Bool("both-tmux", false, "inside tmux, fill tmux's paste buffer too and send OSC52 through passthrough")
+	maxB64 := fs.Int("max-base64-bytes", 0, "also limit the base64-encoded content to this many bytes")
+	maxSeq := fs.Int("max-seq-bytes", 0, "split sequences longer than this (0: per-terminal default)")
+	verify := fs.Bool("verify", false, "read the clipboard back after copying and fail on mismatch")
+	diffClip := fs.Bool("diff-clipboard", false, "skip copying if the clipboard already holds the content")
+	progressFlag := fs.Bool("progress", false, "show a progress bar on the terminal while reading a file")
+	quiet := fs.Bool("q", false, "never print the success status line")
+	statusFlag := fs.Bool("status", false, "print the success status line even when stderr isn't a terminal")
+	statusFormat := fs.String("status-format", defaultStatusFormat, "Go template for the status line after copying")
+	verbose := fs.Bool("v", false, "verbose output")
+	dataURIFlag := fs.Bool("data-uri", false, "copy the content as a base64 data: URI")
+	img := fs.Bool("img", false, "show an image inline and copy its raw bytes")
+	notifyFlag := fs.Bool("notify", false, "show a desktop notification after copying")
+	fs.String("profile", "", "apply the flags under [NAME] in the config file first")
+	help := fs.Bool("h", false, "help")
+	fs.Usage = usage
+	name := profileName(fs, args)
+	// Lists a profile fills are replaced, not extended, by the command line.
+	profileLists := map[string]stringList{}
+	if name != "" {
+		pargs, err := loadProfile(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -profile: %v\n", err)
+			exit(2)
+		}
+		fs.Parse(dropOverridden(fs, pargs, args))
+		if fs.NArg() > 0 || fs.Lookup("profile").Value.String() != "" {
+			fmt.Fprintf(stderr, "rcp: -profile: [%s] may only hold flags (not files or -profile)\n", name)
+			exit(2)
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			if l, ok := f.Value.(*stringList); ok && len(*l) > 0 {
+				profileLists[f.Name] = *l
+				*l = nil
+			}
+		})
+	}
+	fs.Parse(args)
+	if got := fs.Lookup("profile").Value.String(); got != name {
+		fmt.Fprintf(stderr, "rcp: -profile %s was not applied; give -profile only once\n", got)
+		exit(2)
+	}
+	for n, pl := range profileLists {
+		if l := fs.Lookup(n).Value.(*stringList); len(*l) == 0 {
+			*l = pl
+		}
+	}
+
+	// support "/?" and "-?" like the bash version
+	for _, a := range args {
+		if a == "/?" || a == "-?" || a == "--help" {
+			usage()
+		}
+	}
+	if *help {
+		usage()
+	}
+
+	maxBytes := getenvInt("RCOPY_MAX_BYTES", defaultMaxBytes)
+
+	if errs := preflight(fs, fs.Args()); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(stderr, "rcp: "+e)
+		}
+		exit(2)
+	}
+	// statusOut gets the lines reporting success. By default they only show
+	// when stderr is a terminal; errors and warnings always go to stderr.
+	statusOut := stderr
+	if *quiet || !*statusFlag && !isTerminal(stderr) {
+		statusOut = io.Discard
+	}
+	statusTmpl := template.Must(template.New("status").Parse(*statusFormat))
+	customStatus := false
+	fs.Visit(func(f *flag.Flag) { customStatus = customStatus || f.Name == "status-format" })
+	if *plain {
+		for _, name := range plainDisables {
+			f := fs.Lookup(name)
+			if l, ok := f.Value.(*stringList); ok {
+				*l = nil // Set would append
+				continue
+			}
+			f.Value.Set(f.DefValue)
+		}
+	}
+
+	if *cooldown > 0 && !*force {
+		if since := now().Sub(lastCopyTime()); since < *cooldown {
+			fmt.Fprintf(stderr, "rcp: -cooldown: last copy was %s ago (cooldown %s); not copying (use -force)\n", since.Round(time.Millisecond), *cooldown)
+			exit(1)
+		}
+	}
+	// copied records the copy for -cooldown.
+	copied := func() {
+		if *cooldown > 0 {
+			if err := saveLastCopyTime(now()); err != nil {
+				fmt.Fprintf(stderr, "rcp: -cooldown: can't save state: %v\n", err)
+			}
+		}
+	}
+
+	// ctx ends with -max-runtime. Commands are killed when it does, and
+	// reading input or waiting on -paste-service gives up; all then unwind
+	// with errMaxRuntime.
+	ctx := context.Background()
+	if *maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *maxRuntime)
+		defer cancel()
+	}
+	// timedOut turns err into errMaxRuntime if it came from ctx ending.
+	timedOut := func(err error) error {
+		if err != nil && ctx.Err() != nil {
+			return errMaxRuntime
+		}
+		return err
+	}
+	// openInput opens path and returns it along with a reader for its
+	// content. Under -max-runtime both give up once ctx ends: opening a FIFO
+	// waits for a writer, and reading one waits for data.
+	openInput := func(path string) (*os.File, io.Reader, error) {
+		if *maxRuntime <= 0 {
+			f, err := os.Open(path)
+			return f, f, err
+		}
+		type opened struct {
+			f   *os.File
+			err error
+		}
+		ch := make(chan opened, 1)
+		go func() {
+			f, err := os.Open(path)
+			ch <- opened{f, err}
+		}()
+		select {
+		case <-ctx.Done():
+			return nil, nil, errMaxRuntime
+		case o := <-ch:
+			if o.err != nil {
+				return nil, nil, o.err
+			}
+			return o.f, &ctxReader{ctx: ctx, r: o.f}, nil
+		}
+	}
+
+	args = fs.Args()
+
+	mode := ""
+	src := ""
+
+	if *execCmd != "" {
+		mode = "exec"
+	} else if *bridge {
+		mode = "bridge"
+	} else if *peek {
+		mode = "peek"
+	} else if *promote {
+		mode = "promote"
+	} else if *swapSel != "" {
+		mode = "swap"
+	} else if *calcExpr != "" {
+		mode = "calc"
+	} else if *inputs != "" {
+		mode = "inputs"
+	} else if *mapSpec != "" {
+		mode = "map"
+	} else if len(args) >= 1 {
+		if args[0] == "-" {
+			mode = "stdin"
+		} else {
+			mode = "file"
+			src = args[0]
+		}
+	} else {
+		if isStdinPiped() {
+			mode = "stdin"
+		} else {
+			usage()
+		}
+	}
+
+	// -auto-max probes only once the command line is known to be good.
+	if *autoMax && getenv("RCOPY_MAX_BYTES") == "" {
+		if err := probeOSC52(); err != nil {
+			fmt.Fprintf(stderr, "rcp: -auto-max: probe failed (%v); using the default limit %d\n", err, maxBytes)
+		} else {
+			maxBytes = termCaps[terminalKind()].maxBytes
+			if maxBytes == 0 {
+				maxBytes = autoMaxDefault
+			}
+		}
+	}
+	base64Limit = 0
+	if *maxB64 > 0 && rawCapForBase64(*maxB64) <= maxBytes {
+		maxBytes = rawCapForBase64(*maxB64)
+		base64Limit = *maxB64
+	}
+
+	// Content transforms, in the order documented in usage.
+	var transforms []func([]byte) []byte
+	if *interp {
+		vars := map[string]string{}
+		for _, kv := range varList {
+			k, v, _ := strings.Cut(kv, "=")
+			vars[k] = v
+		}
+		transforms = append(transforms, func(b []byte) []byte {
+			b, err := interpolate(b, vars, *interpStrict)
+			if err != nil {
+				fmt.Fprintf(stderr, "rcp: -interp: %v. Refusing.\n", err)
+				exit(1)
+			}
+			return b
+		})
+	}
+	if *urls {
+		transforms = append(transforms, func(b []byte) []byte { return extractURLs(b, *urlsUnique) })
+	}
+	for _, expr := range masks {
+		re := regexp.MustCompile(expr)
+		transforms = append(transforms, func(b []byte) []byte { return maskMatches(b, re) })
+	}
+	if *stripPromptFlag {
+		re := regexp.MustCompile(*promptRegex)
+		transforms = append(transforms, func(b []byte) []byte { return stripPrompt(b, re) })
+	}
+	if *stripStyle != "" {
+		marker := commentMarkers[*stripStyle]
+		transforms = append(transforms, func(b []byte) []byte { return stripComments(b, marker) })
+	}
+	if *joinCont {
+		transforms = append(transforms, joinContinuations)
+	}
+	if *unwrap {
+		transforms = append(transforms, func(b []byte) []byte { return unwrapLines(b, *unwrapSpace) })
+	}
+	if *rtrim {
+		transforms = append(transforms, rtrimLines)
+	}
+	if *stripQuotesFlag {
+		transforms = append(transforms, func(b []byte) []byte { return stripQuotes(b, *perLine) })
+	}
+	if *collapse {
+		transforms = append(transforms, collapseBlank)
+	}
+	if *tidyFlag {
+		transforms = append(transforms, tidy)
+	}
+	if *tilde {
+		home, err := homeDir()
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -tilde: %v\n", err)
+			exit(1)
+		}
+		transforms = append(transforms, func(b []byte) []byte { return tildeHome(b, home, *tildeEnv) })
+	}
+	sorted := *sortFlag || *sortNumeric || *reverse
+	if sorted || *uniq {
+		transforms = append(transforms, func(b []byte) []byte {
+			if sorted && len(b) > sortWarnBytes {
+				fmt.Fprintf(stderr, "rcp: sorting %d bytes in memory\n", len(b))
+			}
+			return sortLines(b, sorted, *sortNumeric, *reverse, *uniq)
+		})
+	}
+	if *escape != "" {
+		lang := *escape
+		transforms = append(transforms, func(b []byte) []byte { return escapeLiteral(b, lang) })
+	}
+	applyTransforms := func(b []byte) []byte {
+		for _, t := range transforms {
+			b = t(b)
+		}
+		return b
+	}
+
+	var out limitedBuffer
+	out.max = maxBytes
+	if *detect {
+		// -detect copies nothing, so the copy limit doesn't apply.
+		out.max = math.MaxInt
+	}
+
+	// afterSend, if set, runs once the OSC52 sequence has been written.
+	var afterSend func()
+
+	// The OSC52 sequence goes to seqOut. With -pass, stdout carries the input
+	// instead and the sequence goes straight to the terminal.
+	var seqOut io.Writer = stdout
+	if *pass {
+		if tty == nil {
+			fmt.Fprintln(stderr, "rcp: -pass needs a terminal: can't open /dev/tty")
+			exit(1)
+		}
+		seqOut = tty
+	}
+	if *record != "" {
+		f, err := os.OpenFile(*record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -record: %v\n", err)
+			exit(1)
+		}
+		defer f.Close()
+		seqOut = &recordWriter{w: seqOut, rec: f, raw: *recordRaw}
+	}
+	inTmux := *bothTmux && getenv("TMUX") != ""
+	if *bothTmux && !inTmux {
+		fmt.Fprintln(stderr, "rcp: -both-tmux: not inside tmux; sending plain OSC52 only")
+	}
+	if inTmux {
+		seqOut = &tmuxWriter{w: seqOut}
+	}
+
+	// report prints the status line for a send through the -status-format
+	// template. usual, if set, is the mode's own wording, printed instead
+	// unless -status-format was given.
+	report := func(info statusInfo, usual string) {
+		info.Duration = now().Sub(start)
+		if info.Wrap == "" {
+			switch {
+			case inTmux:
+				info.Wrap = "tmux"
+			case info.Chunks > 1:
+				info.Wrap = "screen"
+			}
+		}
+		if usual != "" && !customStatus {
+			fmt.Fprintln(statusOut, usual)
+			return
+		}
+		statusTmpl.Execute(statusOut, info)
+		fmt.Fprintln(statusOut)
+	}
+
+	// hostRoom is the limit less the -host header, which goes in front of
+	// whatever is sent. It refuses if the header alone exceeds the limit.
+	hostRoom := func() int {
+		room := maxBytes
+		if *host {
+			room -= len(hostHeader(*hostUser))
+		}
+		if room <= 0 {
+			fmt.Fprintf(stderr, "rcp: the -host header alone exceeds limit %d. Refusing.\n", maxBytes)
+			exit(1)
+		}
+		return room
+	}
+
+	// emitStream sends one update in the streaming modes (-follow, -e-stream):
+	// banner, then the transformed content, each time it is called.
+	emitStream := func(banner, b []byte) {
+		b = append(slices.Clone(banner), applyTransforms(b)...)
+		if *host {
+			b = append([]byte(hostHeader(*hostUser)), b...)
+		}
+		if len(b) > maxBytes {
+			fmt.Fprintf(stderr, "rcp: %d bytes after transforms exceeds limit %d; skipping this update\n", len(b), maxBytes)
+			return
+		}
+		pieces, err := sendOSC52(seqOut, "c", b, *maxSeq)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			exit(1)
+		}
+		report(statusInfo{Bytes: len(b), Chunks: pieces, Mode: mode, Selection: "c"}, fmt.Sprintf("Sent %d bytes via OSC52", len(b)))
+	}
+
+	// checkRoot enforces -root on a file argument.
+	checkRoot := func(path string) {
+		if *root == "" {
+			return
+		}
+		ok, err := withinRoot(*root, path)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: not a file: %s\n", path)
+			exit(1)
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "rcp: %s is outside %s. Refusing.\n", path, *root)
+			exit(exitOutsideRoot)
+		}
+	}
+
+	// passThrough copies what is read to stdout when -pass is set. If the
+	// limit stops buffering, the rest is still passed on before failing.
+	passThrough := func(r io.Reader) io.Reader {
+		if !*pass {
+			return r
+		}
+		return io.TeeReader(r, stdout)
+	}
+	drain := func(r io.Reader) {
+		if *pass {
+			io.Copy(stdout, r)
+		}
+	}
+
+	// Content goes through dst; banners are written to out directly.
+	var dst io.Writer = &out
+	if *ts {
+		dst = &timestampWriter{w: &out, layout: *tsFormat}
+	}
+
+	switch mode {
+	case "exec":
+		if *execDry {
+			if _, err := out.Write([]byte(*execCmd)); err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			break
+		}
+		if *execStream {
+			banner := []byte(*execCmd + unescape(*execSep))
+			room := hostRoom()
+			cmd := shellCommand(ctx, *execCmd, *maxRuntime > 0)
+			if *cleanEnvFlag {
+				cmd.Env = cleanEnv(keepEnv)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			cmd.Stderr = stderr
+			if err := cmd.Start(); err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			var in io.Reader = stdout
+			if *ts {
+				in = stampReader(in, *tsFormat)
+			}
+			window := max(1, room-len(banner))
+			err = followTail(in, window, *streamInterval, *streamInterval, func(b []byte) { emitStream(banner, b) })
+			if werr := cmd.Wait(); err == nil {
+				err = timedOut(werr)
+			}
+			if err != nil {
+				// Command failed; still exit non-zero
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			return
+		}
+		// Each attempt starts from an empty buffer, so only the last
+		// attempt's output is copied.
+		for attempt := 0; ; attempt++ {
+			out.buf.Reset()
+			out.n = 0
+			if t, ok := dst.(*timestampWriter); ok {
+				t.midLine = false
+			}
+			if _, err := out.Write([]byte(*execCmd + unescape(*execSep))); err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+
+			cmd := shellCommand(ctx, *execCmd, *maxRuntime > 0)
+			if *cleanEnvFlag {
+				cmd.Env = cleanEnv(keepEnv)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			cmd.Stderr = stderr
+
+			if err := cmd.Start(); err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+
+			if err := copyLimited(dst, stdout, nil); err != nil {
+				printTooLargeOrDie(err, maxBytes, "<input>")
+			}
+
+			err = timedOut(cmd.Wait())
+			if err == nil {
+				break
+			}
+			if err == errMaxRuntime {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			if attempt >= *retries {
+				// Command failed; still exit non-zero
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			fmt.Fprintf(stderr, "rcp: command failed (%v); retry %d of %d in %s\n", err, attempt+1, *retries, *retryDelay)
+			select {
+			case <-time.After(*retryDelay):
+			case <-ctx.Done():
+				printTooLargeOrDie(errMaxRuntime, maxBytes, "")
+			}
+		}
+
+	case "stdin":
+		src := stdin
+		if *maxRuntime > 0 {
+			src = &ctxReader{ctx: ctx, r: stdin}
+		}
+		var in io.Reader = passThrough(src)
+		if *grep != "" {
+			in = grepReader(in, regexp.MustCompile(*grep), *grepV)
+		}
+		if *follow {
+			if *ts {
+				in = stampReader(in, *tsFormat)
+			}
+			err := followTail(in, hostRoom(), *quietInterval, 0, func(b []byte) { emitStream(nil, b) })
+			if err != nil {
+				printTooLargeOrDie(err, maxBytes, "")
+			}
+			return
+		}
+		if err := copyLimited(dst, in, nil); err != nil {
+			drain(src)
+			printTooLargeOrDie(err, maxBytes, "<input>")
+		}
+
+	case "bridge":
+		c := localPasteCommand(*bridgeFrom)
+		if c == nil {
+			fmt.Fprintln(stderr, "rcp: -bridge: no local display or paste tool (xclip, wl-paste, xsel, pbpaste)")
+			exit(1)
+		}
+		cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			printTooLargeOrDie(err, maxBytes, "")
+		}
+		cmd.Stderr = stderr
+		if err := cmd.Start(); err != nil {
+			printTooLargeOrDie(err, maxBytes, "")
+		}
+		if err := copyLimited(dst, stdout, nil); err != nil {
+			printTooLargeOrDie(timedOut(err), maxBytes, "-bridge")
+		}
+		if err := timedOut(cmd.Wait()); err == errMaxRuntime {
+			printTooLargeOrDie(err, maxBytes, "-bridge")
+		} else if err != nil {
+			fmt.Fprintf(stderr, "rcp: -bridge: %s: %v\n", c[0], err)
+			exit(1)
+		}
+
+	case "peek":
+		data, err := readSelection("c")
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -peek: can't read the clipboard: %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(stderr, "Clipboard holds %d bytes:\n%s\n", len(data), peekText(data, peekMaxBytes))
+		return
+
+	case "promote":
+		from, to := localPasteCommand("primary"), localCopyCommand("clipboard")
+		if from == nil || to == nil {
+			fmt.Fprintln(stderr, "rcp: -promote: needs a local X11 or Wayland display with xclip, xsel or wl-clipboard")
+			exit(1)
+		}
+		data, err := exec.Command(from[0], from[1:]...).Output()
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -promote: %s: %v\n", from[0], err)
+			exit(1)
+		}
+		cmd := exec.Command(to[0], to[1:]...)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(stderr, "rcp: -promote: %s: %v\n", to[0], err)
+			exit(1)
+		}
+		fmt.Fprintf(statusOut, "Copied %d bytes from PRIMARY to CLIPBOARD\n", len(data))
+		return
+
+	case "swap":
+		from, to, _ := strings.Cut(*swapSel, ":")
+		data, err := readSelection(from)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -swap-selection: can't read selection %s: %v\n", from, err)
+			exit(1)
+		}
+		if len(data) > maxBytes {
+			printTooLargeOrDie(errTooLarge(len(data), maxBytes), maxBytes, "selection "+from)
+		}
+		pieces, err := sendOSC52(seqOut, to, data, *maxSeq)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			exit(1)
+		}
+		report(statusInfo{Bytes: len(data), Chunks: pieces, Mode: mode, Selection: to},
+			fmt.Sprintf("Sent %d bytes from selection %s to selection %s via OSC52", len(data), from, to))
+		return
+
+	case "calc":
+		v, err := calc(*calcExpr)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -calc: %v\n", err)
+			exit(1)
+		}
+		if _, err := dst.Write([]byte(v)); err != nil {
+			printTooLargeOrDie(err, maxBytes, "")
+		}
+
+	case "map":
+		for _, item := range strings.Split(*mapSpec, ",") {
+			i := strings.LastIndex(item, ":")
+			path, sel := item[:i], item[i+1:]
+			checkRoot(path)
+			f, r, err := openInput(path)
+			if err == errMaxRuntime {
+				printTooLargeOrDie(err, maxBytes, path)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "rcp: not a file: %s\n", path)
+				exit(1)
+			}
+			w := &clipWriter{out: seqOut, sel: sel, maxSeq: *maxSeq}
+			w.buf.max = maxBytes
+			_, err = io.Copy(w, r)
+			f.Close()
+			if err != nil {
+				printTooLargeOrDie(err, maxBytes, path)
+			}
+			if err := w.Close(); err != nil {
+				fmt.Fprintln(stderr, err)
+				exit(1)
+			}
+			report(statusInfo{Bytes: w.buf.n, Chunks: w.pieces, Mode: mode, Selection: sel},
+				fmt.Sprintf("Sent %d bytes of %s to selection %s via OSC52", w.buf.n, path, sel))
+		}
+		return
+
+	case "inputs":
+		for _, item := range strings.Split(*inputs, ",") {
+			label, path, ok := strings.Cut(item, "=")
+			if !ok {
+				label, path = "", item
+			}
+			checkRoot(path)
+			f, r, err := openInput(path)
+			if err == errMaxRuntime {
+				printTooLargeOrDie(err, maxBytes, "-inputs "+*inputs)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "rcp: not a file: %s\n", path)
+				exit(1)
+			}
+			if label == "" && *headers {
+				label = path
+			}
+			if label != "" {
+				banner := "==> " + label + " <==\n"
+				if fi, err := f.Stat(); err == nil && *headersSize && fi.Mode().IsRegular() {
+					banner = fmt.Sprintf("==> %s (%d bytes) <==\n", label, fi.Size())
+				}
+				if b := out.buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+					banner = "\n" + banner
+				}
+				if _, err := out.Write([]byte(banner)); err != nil {
+					printTooLargeOrDie(err, maxBytes, "-inputs "+*inputs)
+				}
+				// The banner ended the line, so the next one gets a stamp.
+				if t, ok := dst.(*timestampWriter); ok {
+					t.midLine = false
+				}
+			}
+			err = copyLimited(dst, passThrough(r), nil)
+			if err != nil {
+				drain(r)
+			}
+			f.Close()
+			if err != nil {
+				printTooLargeOrDie(err, maxBytes, "-inputs "+*inputs)
+			}
+		}
+
+	case "file":
+		checkRoot(src)
+		f, r, err := openInput(src)
+		if err == errMaxRuntime {
+			printTooLargeOrDie(err, maxBytes, src)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: not a file: %s\n", src)
+			exit(1)
+		}
+		defer f.Close()
+
+		if *withCmd {
+			if _, err := out.Write([]byte("cat " + src + "\n")); err != nil {
+				printTooLargeOrDie(err, maxBytes, src)
+			}
+		}
+
+		if *resume {
+			abs, err := filepath.Abs(src)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				exit(1)
+			}
+			// Leave room for the -host header, which is added later.
+			room := hostRoom()
+			piece, start, next, err := readPiece(f, abs, room)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				exit(1)
+			}
+			if _, err := dst.Write(piece); err != nil {
+				printTooLargeOrDie(err, maxBytes, src)
+			}
+			end := start + int64(len(piece))
+			afterSend = func() {
+				states := loadResumeStates()
+				if next == nil {
+					delete(states, abs)
+					fmt.Fprintf(statusOut, "Copied bytes %d-%d of %s; that was the last piece\n", start, end, src)
+				} else {
+					states[abs] = *next
+					fmt.Fprintf(statusOut, "Copied bytes %d-%d of %s; run rcp -resume %s again for the next piece\n",
+						start, end, src, src)
+				}
+				if err := saveResumeStates(states); err != nil {
+					fmt.Fprintf(stderr, "rcp: -resume: can't save state: %v\n", err)
+				}
+			}
+		} else {
+			var bar *progressBar
+			var progress func(int64)
+			if *progressFlag && !*quiet {
+				if bar = newProgressBar(f); bar != nil {
+					progress = bar.update
+				}
+			}
+			err := copyLimited(dst, passThrough(r), progress)
+			if bar != nil {
+				bar.close()
+			}
+			if err != nil {
+				drain(r)
+				printTooLargeOrDie(err, maxBytes, src)
+			}
+		}
+
+	default:
+		usage()
+	}
+
+	hint := src
+	if hint == "" {
+		hint = "<input>"
+	}
+
+	data := out.buf.Bytes()
+	if *decompress {
+		limit := min(maxBytes, decompressMaxBytes)
+		if *detect {
+			limit = decompressMaxBytes
+		}
+		d, err := gunzip(data, limit)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -decompress: %s: %v. Refusing.\n", hint, err)
+			exit(1)
+		}
+		data = d
+	}
+	if *detect {
+		describeContent(stderr, data)
+		return
+	}
+	if *img {
+		mime := http.DetectContentType(data)
+		if !strings.HasPrefix(mime, "image/") {
+			fmt.Fprintf(stderr, "rcp: -img: %s is not an image (%s)\n", hint, mime)
+			exit(1)
+		}
+		err := errors.New("no terminal")
+		if tty != nil {
+			err = writeInlineImage(tty, inlineImageProtocol(), mime, data)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -img: not displaying inline: %v\n", err)
+		}
+	}
+	if *dataURIFlag {
+		if len(data) > dataURIMaxBytes {
+			fmt.Fprintf(stderr, "rcp: -data-uri: %s is %d bytes; data URIs are capped at %d. Refusing.\n",
+				hint, len(data), dataURIMaxBytes)
+			exit(1)
+		}
+		data = []byte(dataURI(src, data))
+	}
+
+	if *jq != "" {
+		v, err := jsonPath(data, *jq)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -jq %s: %v. Refusing.\n", *jq, err)
+			exit(1)
+		}
+		data = v
+	}
+	if *base != "" {
+		from, to, _ := parseBases(*base)
+		v, err := convertBase(data, from, to)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -base %s: %v. Refusing.\n", *base, err)
+			exit(1)
+		}
+		data = v
+	}
+
+	data = applyTransforms(data)
+
+	if *filter != "" {
+		cmd := shellCommand(ctx, *filter, *maxRuntime > 0)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stderr = stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			printTooLargeOrDie(err, maxBytes, "")
+		}
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(stderr, "rcp: -filter: %v\n", err)
+			exit(1)
+		}
+		var filtered limitedBuffer
+		filtered.max = maxBytes
+		if err := copyLimited(&filtered, stdout, nil); err != nil {
+			// Stop the filter rather than leave it blocked writing to us.
+			cmd.Cancel()
+			cmd.Wait()
+			printTooLargeOrDie(err, maxBytes, hint)
+		}
+		if err := timedOut(cmd.Wait()); err == errMaxRuntime {
+			printTooLargeOrDie(err, maxBytes, "")
+		} else if err != nil {
+			fmt.Fprintf(stderr, "rcp: -filter %q failed (%v); nothing copied\n", *filter, err)
+			exit(1)
+		}
+		data = filtered.buf.Bytes()
+	}
+
+	if *validate != "" {
+		v, err := validateContent(data, *validate, *pretty)
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: %v. Refusing.\n", err)
+			exit(1)
+		}
+		data = v
+	}
+
+	if *host {
+		data = append([]byte(hostHeader(*hostUser)), data...)
+	}
+
+	// Transforms may grow the content; hold the result to the same limit.
+	if len(data) > maxBytes {
+		printTooLargeOrDie(errTooLarge(len(data), maxBytes), maxBytes, hint)
+	}
+
+	// Most terminals take an empty OSC52 write as "clear the clipboard",
+	// which is rarely what an empty pipe meant.
+	if len(data) == 0 {
+		switch *onEmpty {
+		case "refuse":
+			fmt.Fprintf(stderr, "rcp: nothing to copy from %s; leaving the clipboard alone (-on-empty clear or -on-empty allow to send it anyway)\n", hint)
+			exit(1)
+		case "clear":
+			if _, err := io.WriteString(seqOut, clearOSC52("c")); err != nil {
+				fmt.Fprintln(stderr, err)
+				exit(1)
+			}
+			fmt.Fprintln(statusOut, "Cleared clipboard")
+			return
+		}
+	}
+
+	if *pasteService != "" {
+		link, err := pasteContent(ctx, *pasteService, *pasteFormat, *pasteField, getenv("RCOPY_PASTE_AUTH"), data)
+		if err := timedOut(err); err == errMaxRuntime {
+			printTooLargeOrDie(err, maxBytes, "")
+		} else if err != nil {
+			fmt.Fprintf(stderr, "rcp: -paste-service: %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(statusOut, "Pasted %d bytes to %s\n", len(data), link)
+		data = []byte(link)
+	}
+
+	if *diffClip {
+		cur, err := readSelection("c")
+		switch {
+		case err != nil:
+			fmt.Fprintf(stderr, "rcp: -diff-clipboard: can't read clipboard (%v); copying anyway\n", err)
+		case bytes.Equal(cur, data):
+			fmt.Fprintf(statusOut, "Clipboard already holds these %d bytes; not copying\n", len(data))
+			return
+		case *verbose:
+			lineDiff(stderr, cur, data)
+		}
+	}
+
+	// Emit OSC52 (stdout ONLY)
+	var pieces int
+	var err error
+	kitty := *chunkResume && terminalKind() == "xterm-kitty"
+	if kitty {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		chunk := kittyChunk
+		if *maxSeq > 0 {
+			chunk = *maxSeq - osc52Len(0)
+		}
+		pieces, err = writeKittyOSC52(seqOut, "c", data, chunk, interrupt)
+		signal.Stop(interrupt)
+	} else {
+		if *chunkResume {
+			fmt.Fprintf(stderr, "rcp: -chunk-resume: %s has no framed chunks (only kitty does); sending as usual\n", terminalKind())
+		}
+		pieces, err = sendOSC52(seqOut, "c", data, *maxSeq)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		exit(1)
+	}
+	if inTmux {
+		if err := setTmuxBuffer(data); err != nil {
+			fmt.Fprintf(stderr, "rcp: -both-tmux: %v\n", err)
+			exit(1)
+		}
+	}
+
+	copied()
+
+	// Status to stderr
+	info := statusInfo{Bytes: len(data), Chunks: pieces, Mode: mode, Selection: "c"}
+	if kitty {
+		info.Wrap = "kitty"
+	}
+	report(info, "")
+	if *verify {
+		got, err := queryOSC52("c", clipboardReadTimeout)
+		if err == nil {
+			err = verifyClipboard(got, data)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "rcp: -verify: %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintln(statusOut, "Verified: clipboard matches")
+	}
+	if *notifyFlag {
+		from := map[string]string{
+			"exec":   "command output",
+			"bridge": "the local clipboard",
+			"inputs": "-inputs",
+			"calc":   "-calc",
+			"stdin":  "stdin",
+			"file":   filepath.Base(src),
+		}[mode]
+		notify("rcp", fmt.Sprintf("Copied %d bytes from %s", len(data), from))
+	}
+	if afterSend != nil {
+		afterSend()
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// openPTY returns the two ends of a new pseudo-terminal, or skips the test
+// if there is none.
+func openPTY(t *testing.T) (ptmx, pts *os.File) {
+	t.Helper()
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	t.Cleanup(func() { ptmx.Close() })
+	var n, unlock uint32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		t.Skipf("unlocking the pty: %v", e)
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); e != 0 {
+		t.Skipf("naming the pty: %v", e)
+	}
+	pts, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("opening the pty: %v", err)
+	}
+	t.Cleanup(func() { pts.Close() })
+	return ptmx, pts
+}
+
+func TestRunStatusOnTerminal(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "Sent 2 bytes via OSC52"},
+		{[]string{"-status"}, "Sent 2 bytes via OSC52"},
+		{[]string{"-q"}, ""},
+	}
+	for _, tt := range tests {
+		ptmx, pts := openPTY(t)
+		var out strings.Builder
+		code := run(tt.args, strings.NewReader("hi"), &out, pts, nil, func(string) string { return "" })
+		if code != 0 || copied(t, out.String()) != "hi" {
+			t.Errorf("%q: status %d", tt.args, code)
+		}
+		pts.Close()
+		shown, _ := io.ReadAll(ptmx) // EIO once the other end is closed
+		if got := strings.TrimSpace(string(shown)); got != tt.want {
+			t.Errorf("%q: terminal stderr %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,3103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+)
+
+// runRCP runs rcp with args and stdin, without a terminal, and returns what
+// it wrote to stdout and stderr and its exit status. The environment holds
+// PATH, a private HOME, and env on top.
+func runRCP(t *testing.T, env map[string]string, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	return runTerm(t, nil, env, stdin, args...)
+}
+
+// runTerm is runRCP with term as the terminal. When term is set it also
+// stands in for stdout, so the OSC52 sequences go to it like they would to a
+// real terminal; the returned stdout is then empty.
+func runTerm(t *testing.T, term io.ReadWriter, env map[string]string, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	vars := map[string]string{"PATH": os.Getenv("PATH"), "HOME": t.TempDir()}
+	for k, v := range env {
+		vars[k] = v
+	}
+	var out, errb strings.Builder
+	var outw, ttyw io.Writer = &out, nil
+	if term != nil {
+		outw, ttyw = term, term
+	}
+	code := run(args, strings.NewReader(stdin), outw, &errb, ttyw, func(k string) string { return vars[k] })
+	return out.String(), errb.String(), code
+}
+
+// osc52Write is one OSC52 write found in rcp's output.
+type osc52Write struct {
+	sel, data string
+}
+
+var osc52Re = regexp.MustCompile("\033\\]52;([^;]*);([^\033\a]*)(?:\033\\\\|\a)")
+
+// osc52Writes decodes the OSC52 writes in out, in order. A clear ("!") has
+// data "!".
+func osc52Writes(t *testing.T, out string) []osc52Write {
+	t.Helper()
+	var ws []osc52Write
+	for _, m := range osc52Re.FindAllStringSubmatch(out, -1) {
+		if m[2] == "!" || m[2] == "?" {
+			ws = append(ws, osc52Write{m[1], m[2]})
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(m[2])
+		if err != nil {
+			t.Fatalf("bad base64 in %q: %v", m[0], err)
+		}
+		ws = append(ws, osc52Write{m[1], string(b)})
+	}
+	return ws
+}
+
+// copied returns the content of the single clipboard write in out.
+func copied(t *testing.T, out string) string {
+	t.Helper()
+	ws := osc52Writes(t, out)
+	if len(ws) != 1 || ws[0].sel != "c" {
+		t.Fatalf("want one clipboard write, got %q from %q", ws, out)
+	}
+	return ws[0].data
+}
+
+// checkRun checks a run's result: exit status code, the single clipboard
+// write (or nothing sent, when copied is empty), and stderr, which must
+// contain wantErr (or be empty, when wantErr is empty).
+func checkRun(t *testing.T, out, errs string, code int, copiedWant, wantErr string, codeWant int) {
+	t.Helper()
+	if code != codeWant {
+		t.Errorf("exit status %d, want %d (stderr %q)", code, codeWant, errs)
+	}
+	if copiedWant == "" {
+		if out != "" {
+			t.Errorf("stdout %q, want nothing", out)
+		}
+	} else if got := copied(t, out); got != copiedWant {
+		t.Errorf("copied %q, want %q", got, copiedWant)
+	}
+	if wantErr == "" && errs != "" || !strings.Contains(errs, wantErr) {
+		t.Errorf("stderr %q, want %q", errs, wantErr)
+	}
+}
+
+// setGetenv makes rcp's environment env for the rest of the test, for code
+// called without going through run.
+func setGetenv(t *testing.T, env map[string]string) {
+	saved := getenv
+	getenv = func(k string) string { return env[k] }
+	t.Cleanup(func() { getenv = saved })
+}
+
+// fakeTerm is a terminal that keeps what is written to it and holds the
+// selections set through OSC52, answering OSC52 reads from them unless mute.
+type fakeTerm struct {
+	mu    sync.Mutex
+	out   bytes.Buffer
+	seen  int // out is parsed for OSC52 sequences up to here
+	clip  map[string]string
+	mute  bool
+	keep  func(string) string // if set, what the terminal keeps of a write
+	reads int
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+}
+
+// newFakeTerm returns a fakeTerm whose selections start out as clip.
+func newFakeTerm(t *testing.T, clip map[string]string) *fakeTerm {
+	ft := &fakeTerm{clip: map[string]string{}}
+	for k, v := range clip {
+		ft.clip[k] = v
+	}
+	ft.pr, ft.pw = io.Pipe()
+	t.Cleanup(func() { ft.pw.Close() })
+	return ft
+}
+
+func (ft *fakeTerm) Write(p []byte) (int, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.out.Write(p)
+	for {
+		loc := osc52Re.FindSubmatchIndex(ft.out.Bytes()[ft.seen:])
+		if loc == nil {
+			break
+		}
+		b := ft.out.Bytes()[ft.seen:]
+		sel, data := string(b[loc[2]:loc[3]]), string(b[loc[4]:loc[5]])
+		ft.seen += loc[1]
+		switch data {
+		case "?":
+			ft.reads++
+			if !ft.mute {
+				reply := "\033]52;" + sel + ";" + base64.StdEncoding.EncodeToString([]byte(ft.clip[sel])) + "\033\\"
+				go ft.pw.Write([]byte(reply))
+			}
+		case "!":
+			delete(ft.clip, sel)
+		default:
+			d, _ := base64.StdEncoding.DecodeString(data)
+			ft.clip[sel] = string(d)
+			if ft.keep != nil {
+				ft.clip[sel] = ft.keep(string(d))
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (ft *fakeTerm) Read(p []byte) (int, error) { return ft.pr.Read(p) }
+
+// String returns everything written to the terminal.
+func (ft *fakeTerm) String() string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.out.String()
+}
+
+// selection returns what selection sel holds now.
+func (ft *fakeTerm) selection(sel string) string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.clip[sel]
+}
+
+// fakeBins puts executable shell scripts, named by the keys of scripts and
+// running their values, in a directory at the front of PATH for the rest of
+// the test.
+func fakeBins(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// setNow fixes the clock at tm for the rest of the test.
+func setNow(t *testing.T, tm time.Time) {
+	saved := now
+	now = func() time.Time { return tm }
+	t.Cleanup(func() { now = saved })
+}
+
+// writeFile creates name in dir with content and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	notes := writeFile(t, dir, "notes.txt", "hello\nworld\n")
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		env    map[string]string
+		copied string // the clipboard content; "" means nothing may be sent
+		stderr string // a part of stderr; "" means stderr must be empty
+		code   int
+	}{
+		{"file", []string{notes}, "", nil, "hello\nworld\n", "", 0},
+		{"file with command", []string{"-c", notes}, "", nil, "cat " + notes + "\nhello\nworld\n", "", 0},
+		{"missing file", []string{filepath.Join(dir, "nope")}, "", nil, "", "rcp: not a file: ", 1},
+		{"file over the limit", []string{notes}, "", map[string]string{"RCOPY_MAX_BYTES": "5"}, "", "rcp: 12 bytes exceeds limit 5. Refusing.", 1},
+		{"piped stdin", nil, "piped\n", nil, "piped\n", "", 0},
+		{"explicit stdin", []string{"-"}, "dash\n", nil, "dash\n", "", 0},
+		{"stdin over the limit", []string{"-"}, "abcdef", map[string]string{"RCOPY_MAX_BYTES": "3"}, "", "rcp: 6 bytes exceeds limit 3. Refusing.", 1},
+		{"status on request", []string{"-status", "-"}, "hi", nil, "hi", "Sent 2 bytes via OSC52\n", 0},
+		{"exec", []string{"-e", "echo hi"}, "", nil, "echo hi\nhi\n", "", 0},
+		{"exec with a custom separator", []string{"-e", "echo hi", "-e-sep", `\n$ `}, "", nil, "echo hi\n$ hi\n", "", 0},
+		{"exec failure", []string{"-e", "echo partial; exit 3"}, "", nil, "", "exit status 3", 1},
+		{"exec environment comes from env", []string{"-clean-env", "-e", "echo $HOME"}, "", map[string]string{"HOME": "/home/from-env"}, "echo $HOME\n/home/from-env\n", "", 0},
+		{"unknown flag", []string{"-nope"}, "", nil, "", "flag provided but not defined: -nope", 2},
+		{"conflicting flags", []string{"-c", "-e", "true", notes}, "", nil, "", "rcp: -c can't be used with -e", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, tt.stdin, tt.args...)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	var errb strings.Builder
+	code := run(nil, nil, io.Discard, &errb, nil, func(string) string { return "" })
+	if code != 2 || !strings.Contains(errb.String(), "Usage:") {
+		t.Errorf("no input: status %d, stderr %q; want usage and 2", code, errb.String())
+	}
+}
+
+func TestRunClock(t *testing.T) {
+	setNow(t, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	out, errs, code := runRCP(t, nil, "a\nb\n", "-ts", "-ts-format", "15:04:05", "-status", "-status-format", "took {{.Duration}}", "-")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	if got, want := copied(t, out), "07:08:09 a\n07:08:09 b\n"; got != want {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+	if errs != "took 0s\n" {
+		t.Errorf("stderr %q, want %q", errs, "took 0s\n")
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name, format, in string
+		pretty           bool
+		want             string // the content copied, or the error when it starts with "invalid"
+	}{
+		{"json object", "json", `{"a": [1, 2]}`, false, `{"a": [1, 2]}`},
+		{"json pretty", "json", `{"a":[1,2]}`, true, "{\n  \"a\": [\n    1,\n    2\n  ]\n}\n"},
+		{"json trailing comma", "json", "{\n  \"a\": [1,]\n}", false, "invalid JSON at line 2, column 12: invalid character ']' looking for beginning of value"},
+		{"json truncated", "json", `{"a": 1`, false, "invalid JSON at line 1, column 8: unexpected end of JSON input"},
+		{"yaml mapping", "yaml", "name: rcp\ntags:\n  - a\n  - b: c\n    d: e\nempty:\n", false, ""},
+		{"yaml sequence at key indent", "yaml", "steps:\n- run: make\n- run: make test\n", false, ""},
+		{"yaml block scalar", "yaml", "script: |\n  echo a: b\n    - not a list\ndone: true\n", false, ""},
+		{"yaml flow and quotes", "yaml", "a: [1, {b: 'it''s'}, \"x: y\"]\nc: {d: [\n  e, f]}\n", false, ""},
+		{"yaml documents and comments", "yaml", "%YAML 1.2\n---\n# top\na: 1 # one\n...\n---\nb: &x 2\nc: *x\n", false, ""},
+		{"yaml plain continuation", "yaml", "a: one\n  two\n  - three\nb: 3\n", false, ""},
+		{"yaml tags", "yaml", "- !sum [{a: b}]\n- !!str c\n- !t d: e\n", false, ""},
+		{"yaml merge keys", "yaml", "a:\n  <<: *x\n  <<: *y\n", false, ""},
+		{"yaml crlf", "yaml", "a: 1\r\nb:\r\n  - 2\r\n", false, ""},
+		{"yaml scalar document", "yaml", "just text\n", false, ""},
+		{"yaml tab indent", "yaml", "a:\n\tb: 1\n", false, "invalid YAML at line 2, column 1: tabs can't be used for indentation"},
+		{"yaml bad dedent", "yaml", "a:\n    b: 1\n  c: 2\n", false, "invalid YAML at line 3, column 3: indentation doesn't match any enclosing block"},
+		{"yaml unexpected indent", "yaml", "a: 1\n  b: 2\n", false, "invalid YAML at line 2, column 4: mapping values are not allowed here"},
+		{"yaml nested colon", "yaml", "a: b: c\n", false, "invalid YAML at line 1, column 5: mapping values are not allowed here"},
+		{"yaml duplicate key", "yaml", "a: 1\nb: 2\na: 3\n", false, "invalid YAML at line 3, column 1: duplicate key a"},
+		{"yaml key in a sequence", "yaml", "- a\nb: c\n", false, "invalid YAML at line 2, column 1: expected a sequence entry (- ...), found a mapping key"},
+		{"yaml unterminated quote", "yaml", "a: \"open\nb: 2\n", false, "invalid YAML at line 1, column 4: unterminated double-quoted string"},
+		{"yaml unclosed flow", "yaml", "a: [1, 2\n", false, "invalid YAML at line 1, column 4: unterminated flow sequence ([)"},
+		{"yaml mismatched bracket", "yaml", "a: [1, 2}\n", false, "invalid YAML at line 1, column 9: unexpected '}'"},
+		{"yaml text after a quote", "yaml", "a: 'x' y\n", false, "invalid YAML at line 1, column 8: unexpected text after the value"},
+		{"yaml complex key", "yaml", "? a\n: b\n", false, "invalid YAML at line 1, column 1: complex keys (?) aren't supported"},
+		{"yaml after the root", "yaml", "[1]\nb: 2\n", false, "invalid YAML at line 2, column 1: unexpected content after the document's root value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateContent([]byte(tt.in), tt.format, tt.pretty)
+			switch {
+			case strings.HasPrefix(tt.want, "invalid"):
+				if err == nil || err.Error() != tt.want {
+					t.Errorf("error %v, want %q", err, tt.want)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.want != "" && string(got) != tt.want:
+				t.Errorf("got %q, want %q", got, tt.want)
+			case tt.want == "" && string(got) != tt.in:
+				t.Errorf("got %q, want the input unchanged", got)
+			}
+		})
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "a: b: c\n", "-validate", "yaml")
+	if code != 1 || out != "" || !strings.Contains(errs, "rcp: invalid YAML at line 1, column 5") {
+		t.Errorf("bad YAML: status %d, stdout %q, stderr %q", code, out, errs)
+	}
+	out, errs, code = runRCP(t, nil, "a: 1\n", "-validate", "yaml")
+	if code != 0 || copied(t, out) != "a: 1\n" {
+		t.Errorf("good YAML: status %d, stderr %q", code, errs)
+	}
+	_, errs, code = runRCP(t, nil, "a: 1\n", "-validate", "yaml", "-pretty")
+	if code != 2 || !strings.Contains(errs, "-pretty only works with -validate json") {
+		t.Errorf("-pretty with yaml: status %d, stderr %q", code, errs)
+	}
+	_, errs, code = runRCP(t, nil, "x", "-validate", "toml")
+	if code != 2 || !strings.Contains(errs, `-validate: unknown value "toml" (json, yaml)`) {
+		t.Errorf("unknown format: status %d, stderr %q", code, errs)
+	}
+}
+
+// tinyPNG returns a 1x1 PNG.
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRunImg(t *testing.T) {
+	dir := t.TempDir()
+	pic := tinyPNG(t)
+	b64 := base64.StdEncoding.EncodeToString(pic)
+	pngFile := writeFile(t, dir, "dot.png", string(pic))
+	gifFile := writeFile(t, dir, "dot.gif", "GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	textFile := writeFile(t, dir, "notes.txt", "not a picture\n")
+	tests := []struct {
+		name   string
+		env    map[string]string
+		file   string
+		inline string // the inline image sequence expected on the terminal
+		stderr string
+		code   int
+	}{
+		{"kitty png", map[string]string{"TERM": "xterm-kitty"}, pngFile, "\033_Ga=T,f=100,m=0;" + b64 + "\033\\", "", 0},
+		{"iterm png", map[string]string{"TERM_PROGRAM": "iTerm.app"}, pngFile, fmt.Sprintf("\033]1337;File=inline=1;size=%d:%s\a", len(pic), b64), "", 0},
+		{"kitty gif", map[string]string{"TERM": "xterm-kitty"}, gifFile, "", "rcp: -img: not displaying inline: kitty inline display needs PNG, got image/gif", 0},
+		{"unknown terminal", map[string]string{"TERM": "xterm"}, pngFile, "", "rcp: -img: not displaying inline: no inline image support detected (TERM=xterm)", 0},
+		{"not an image", map[string]string{"TERM": "xterm-kitty"}, textFile, "", "is not an image (text/plain; charset=utf-8)", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := newFakeTerm(t, nil)
+			_, errs, code := runTerm(t, term, tt.env, "", "-img", tt.file)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (stderr %q)", code, tt.code, errs)
+			}
+			if tt.stderr == "" && errs != "" || !strings.Contains(errs, tt.stderr) {
+				t.Errorf("stderr %q, want %q", errs, tt.stderr)
+			}
+			if !strings.Contains(term.String(), tt.inline) {
+				t.Errorf("terminal got %q, want it to contain %q", term.String(), tt.inline)
+			}
+			if tt.code != 0 {
+				return
+			}
+			// OSC52 carries the image's own bytes, base64-encoded on the wire.
+			raw, _ := os.ReadFile(tt.file)
+			if got := copied(t, term.String()); got != string(raw) {
+				t.Errorf("copied %q, want the file's bytes", got)
+			}
+		})
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	tests := []struct {
+		name, style, in, want string
+	}{
+		{"hash full line", "hash", "# header\nkey = 1\n  # indented\n", "key = 1\n"},
+		{"hash trailing", "hash", "key = 1   # the key\n", "key = 1\n"},
+		{"hash inside quotes", "hash", "color = \"#fff\" # white\nname = 'a # b'\n", "color = \"#fff\"\nname = 'a # b'\n"},
+		{"hash glued to text", "hash", "url = http://x/#frag\nissue#12\n", "url = http://x/#frag\nissue#12\n"},
+		{"hash crlf", "hash", "a = 1 # one\r\n# two\r\nb = 2\r\n", "a = 1\r\nb = 2\r\n"},
+		{"hash no final newline", "hash", "a = 1 # one", "a = 1"},
+		{"slash full line", "slash", "// header\nint x = 1;\n", "int x = 1;\n"},
+		{"slash trailing", "slash", "int x = 1; // one\nurl(\"http://x\");\n", "int x = 1;\nurl(\"http://x\");\n"},
+		{"semicolon", "semicolon", "; comment\n[core]\nname = x ; trailing\n", "[core]\nname = x\n"},
+		{"unmatched quote", "semicolon", "name = O'Brien ; token=abc\nq = \"open ; gone\n", "name = O'Brien\nq = \"open\n"},
+		{"escaped quote", "hash", "s = \"a \\\" # b\" # c\n", "s = \"a \\\" # b\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripComments([]byte(tt.in), commentMarkers[tt.style])); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunStripComments(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "# secret=hunter2\nkey = 1 # note\n", "-strip-comments", "hash")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	if got := copied(t, out); got != "key = 1\n" {
+		t.Errorf("copied %q, want %q", got, "key = 1\n")
+	}
+	if _, errs, code := runRCP(t, nil, "x", "-strip-comments", "percent"); code != 2 || !strings.Contains(errs, `-strip-comments: unknown value "percent"`) {
+		t.Errorf("unknown style: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestEscapeLiteral(t *testing.T) {
+	const in = "say \"hi\"\nit's a\ttab \\ <b>\x01"
+	tests := []struct {
+		lang, want string
+	}{
+		{"go", `"say \"hi\"\nit's a\ttab \\ <b>\x01"`},
+		{"json", `"say \"hi\"\nit's a\ttab \\ <b>\u0001"`},
+		{"shell", "'say \"hi\"\nit'\\''s a\ttab \\ <b>\x01'"},
+		{"python", `"say \"hi\"\nit's a\ttab \\ <b>\x01"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			if got := string(escapeLiteral([]byte(in), tt.lang)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// The shell literal must read back as the input.
+	lit := escapeLiteral([]byte(in), "shell")
+	got, err := exec.Command("bash", "-c", "printf %s "+string(lit)).Output()
+	if err != nil || string(got) != in {
+		t.Errorf("bash read the shell literal as %q (%v), want %q", got, err, in)
+	}
+}
+
+func TestRunEscape(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "a \"b\"\n", "-escape", "go")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	if got, want := copied(t, out), `"a \"b\"\n"`; got != want {
+		t.Errorf("copied %s, want %s", got, want)
+	}
+}
+
+func TestRunDiffClipboard(t *testing.T) {
+	tests := []struct {
+		name   string
+		clip   string
+		args   []string
+		copied bool
+		stderr string
+	}{
+		{"identical", "same\n", nil, false, "Clipboard already holds these 5 bytes; not copying\n"},
+		{"different", "old\n", nil, true, "Sent 4 bytes via OSC52\n"},
+		{"different, verbose", "a\nold\n", []string{"-v"}, true, "-old\n+new\nSent 6 bytes via OSC52\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := "same\n"
+			if tt.copied {
+				in = strings.Replace(tt.clip, "old", "new", 1)
+			}
+			term := newFakeTerm(t, map[string]string{"c": tt.clip})
+			_, errs, code := runTerm(t, term, nil, in, append([]string{"-diff-clipboard", "-status"}, tt.args...)...)
+			if code != 0 {
+				t.Fatalf("status %d: %s", code, errs)
+			}
+			if errs != tt.stderr {
+				t.Errorf("stderr %q, want %q", errs, tt.stderr)
+			}
+			want := tt.clip
+			if tt.copied {
+				want = in
+			}
+			if got := term.selection("c"); got != want {
+				t.Errorf("clipboard holds %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunDiffClipboardLocal(t *testing.T) {
+	fakeBins(t, map[string]string{"xclip": "printf same"})
+	term := newFakeTerm(t, nil)
+	_, errs, code := runTerm(t, term, map[string]string{"DISPLAY": ":0"}, "same", "-diff-clipboard", "-status")
+	if code != 0 || errs != "Clipboard already holds these 4 bytes; not copying\n" {
+		t.Errorf("status %d, stderr %q", code, errs)
+	}
+	if term.reads != 0 || term.String() != "" {
+		t.Errorf("terminal was used: %q", term.String())
+	}
+}
+
+func TestRunDiffClipboardUnreadable(t *testing.T) {
+	term := newFakeTerm(t, nil)
+	term.mute = true
+	_, errs, code := runTerm(t, term, nil, "x", "-diff-clipboard")
+	if code != 0 || !strings.Contains(errs, "can't read clipboard (no reply from terminal") {
+		t.Errorf("status %d, stderr %q", code, errs)
+	}
+	if got := term.selection("c"); got != "x" {
+		t.Errorf("clipboard holds %q, want it copied anyway", got)
+	}
+}
+
+func TestTimestampWriter(t *testing.T) {
+	// Each reading of the clock is a second later than the last.
+	tm := time.Date(2024, 5, 6, 7, 8, 0, 0, time.UTC)
+	saved := now
+	now = func() time.Time { tm = tm.Add(time.Second); return tm }
+	t.Cleanup(func() { now = saved })
+
+	var out bytes.Buffer
+	w := &timestampWriter{w: &out, layout: "15:04:05"}
+	for _, s := range []string{"first\nsec", "ond\n", "\nlast"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A line is stamped when it starts, not when it ends.
+	want := "07:08:01 first\n07:08:02 second\n07:08:03 \n07:08:04 last"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestRunTimestamps(t *testing.T) {
+	setNow(t, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	dir := t.TempDir()
+	f1 := writeFile(t, dir, "f1", "a")
+	f2 := writeFile(t, dir, "f2", "b\nc\n")
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		want  string
+	}{
+		{"inputs with banners", []string{"-ts", "-ts-format", "X", "-headers", "-inputs", f1 + "," + f2}, "",
+			"==> " + f1 + " <==\nX a\n==> " + f2 + " <==\nX b\nX c\n"},
+		{"default format", []string{"-ts"}, "a\nb", "2024-05-06 07:08:09 a\n2024-05-06 07:08:09 b"},
+		{"custom format", []string{"-ts", "-ts-format", "[15:04]"}, "a\n", "[07:08] a\n"},
+		{"exec output only", []string{"-ts", "-ts-format", "15:04:05", "-e", "printf 'x\\ny\\n'"}, "", "printf 'x\\ny\\n'\n07:08:09 x\n07:08:09 y\n"},
+		{"before other transforms", []string{"-ts", "-ts-format", "15:04:05", "-sort", "-reverse"}, "a\nb\n", "07:08:09 b\n07:08:09 a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, tt.stdin, tt.args...)
+			if code != 0 {
+				t.Fatalf("status %d: %s", code, errs)
+			}
+			if got := copied(t, out); got != tt.want {
+				t.Errorf("copied %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, errs, code := runRCP(t, nil, "a", "-ts-format", "15:04"); code != 2 || !strings.Contains(errs, "-ts-format requires -ts") {
+		t.Errorf("-ts-format alone: status %d, stderr %q", code, errs)
+	}
+}
+
+// unscreen joins the DCS strings of screen's chunked OSC52 form back into
+// the single sequence screen passes to the outer terminal.
+func unscreen(out string) string {
+	out = strings.ReplaceAll(out, "\033\\\033P", "")
+	out = strings.ReplaceAll(out, "\033P\033]52;", "\033]52;")
+	return strings.ReplaceAll(out, "\a\033\\", "\a")
+}
+
+func TestRunMaxSeqBytes(t *testing.T) {
+	big := strings.Repeat("x", 1000) // 1345 bytes as one sequence
+	small := "hi"
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		in      string
+		chunked bool
+		pieces  int
+		warning string
+	}{
+		{"screen default over", map[string]string{"STY": "1.pts"}, nil, big, true, 18, ""},
+		{"screen default under", map[string]string{"STY": "1.pts"}, nil, small, false, 1, ""},
+		{"screen flag over", map[string]string{"STY": "1.pts"}, []string{"-max-seq-bytes", "12"}, small, true, 1, ""},
+		{"screen flag raises the limit", map[string]string{"STY": "1.pts"}, []string{"-max-seq-bytes", "2000"}, big, false, 1, ""},
+		{"no chunked form", map[string]string{"TERM": "xterm"}, []string{"-max-seq-bytes", "100"}, big, false, 1, "rcp: sequence is 1345 bytes (over 100) but xterm has no chunked form; sending it whole\n"},
+		{"no known limit", map[string]string{"TERM": "xterm"}, nil, big, false, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, tt.in, append([]string{"-status"}, tt.args...)...)
+			if code != 0 {
+				t.Fatalf("status %d: %s", code, errs)
+			}
+			status := fmt.Sprintf("Sent %d bytes via OSC52\n", len(tt.in))
+			if tt.pieces > 1 {
+				status = fmt.Sprintf("Sent %d bytes via OSC52 (%d chunks)\n", len(tt.in), tt.pieces)
+			}
+			if errs != tt.warning+status {
+				t.Errorf("stderr %q, want %q", errs, tt.warning+status)
+			}
+			if chunked := strings.HasPrefix(out, "\033P"); chunked != tt.chunked {
+				t.Errorf("chunked %v, want %v: %q", chunked, tt.chunked, out)
+			}
+			if got := copied(t, unscreen(out)); got != tt.in {
+				t.Errorf("copied %q, want %q", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestRunBridge(t *testing.T) {
+	fakeBins(t, map[string]string{
+		"xclip":    `printf 'xclip %s' "$*"`,
+		"wl-paste": `[ "$FAIL" ] && { echo broken >&2; exit 4; }; printf 'wl-paste %s' "$*"`,
+	})
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"x11 clipboard", map[string]string{"DISPLAY": ":0"}, nil, "xclip -o -selection clipboard", "", 0},
+		{"x11 primary", map[string]string{"DISPLAY": ":0"}, []string{"-bridge-from", "primary"}, "xclip -o -selection primary", "", 0},
+		{"wayland first", map[string]string{"DISPLAY": ":0", "WAYLAND_DISPLAY": "wayland-0"}, nil, "wl-paste -n", "", 0},
+		{"wayland primary", map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, []string{"-bridge-from", "primary"}, "wl-paste -n -p", "", 0},
+		{"no display", nil, nil, "", "rcp: -bridge: no local display or paste tool", 1},
+		{"over the limit", map[string]string{"DISPLAY": ":0", "RCOPY_MAX_BYTES": "5"}, nil, "", "exceeds limit 5", 1},
+		{"tool fails", map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, nil, "", "broken\nrcp: -bridge: wl-paste: exit status 4\n", 1},
+		{"with a file", map[string]string{"DISPLAY": ":0"}, []string{"notes.txt"}, "", "rcp: -bridge can't be used with a file argument", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "tool fails" {
+				t.Setenv("FAIL", "1") // the tool runs in rcp's own environment
+			}
+			term := newFakeTerm(t, nil)
+			_, errs, code := runTerm(t, term, tt.env, "", append([]string{"-bridge"}, tt.args...)...)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (stderr %q)", code, tt.code, errs)
+			}
+			if tt.stderr == "" && errs != "" || !strings.Contains(errs, tt.stderr) {
+				t.Errorf("stderr %q, want %q", errs, tt.stderr)
+			}
+			if got := term.selection("c"); got != tt.copied {
+				t.Errorf("clipboard holds %q, want %q", got, tt.copied)
+			}
+		})
+	}
+}
+
+func TestRunRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, root, "sub/in.txt", "inside\n")
+	writeFile(t, base, "secret.txt", "outside\n")
+	if err := os.Mkdir(filepath.Join(base, "rootevil"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, base, "rootevil/x.txt", "sibling\n")
+	for link, target := range map[string]string{
+		"escape.txt": filepath.Join(base, "secret.txt"),
+		"inner.txt":  filepath.Join(root, "sub", "in.txt"),
+		"updir":      "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A root given through a symlink is resolved too.
+	rootLink := filepath.Join(base, "rootlink")
+	if err := os.Symlink(root, rootLink); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		root   string
+		args   []string
+		copied string
+		code   int
+	}{
+		{"inside", root, []string{filepath.Join(root, "sub", "in.txt")}, "inside\n", 0},
+		{"inside via dot-dot", root, []string{filepath.Join(root, "sub", "..", "sub", "in.txt")}, "inside\n", 0},
+		{"symlink staying inside", root, []string{filepath.Join(root, "inner.txt")}, "inside\n", 0},
+		{"root through a symlink", rootLink, []string{filepath.Join(root, "sub", "in.txt")}, "inside\n", 0},
+		{"outside", root, []string{filepath.Join(base, "secret.txt")}, "", exitOutsideRoot},
+		{"dot-dot escape", root, []string{filepath.Join(root, "sub", "..", "..", "secret.txt")}, "", exitOutsideRoot},
+		{"symlink escape", root, []string{filepath.Join(root, "escape.txt")}, "", exitOutsideRoot},
+		{"symlinked directory escape", root, []string{filepath.Join(root, "updir", "secret.txt")}, "", exitOutsideRoot},
+		{"sibling with the root as prefix", root, []string{filepath.Join(base, "rootevil", "x.txt")}, "", exitOutsideRoot},
+		{"inputs entry outside", root, []string{"-inputs", filepath.Join(root, "sub", "in.txt") + "," + filepath.Join(root, "escape.txt")}, "", exitOutsideRoot},
+		{"map entry outside", root, []string{"-map", filepath.Join(root, "escape.txt") + ":c"}, "", exitOutsideRoot},
+		{"missing file", root, []string{filepath.Join(root, "nope.txt")}, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, "", append([]string{"-root", tt.root}, tt.args...)...)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (stderr %q)", code, tt.code, errs)
+			}
+			if tt.code == exitOutsideRoot && !strings.Contains(errs, " is outside "+tt.root+". Refusing.") {
+				t.Errorf("stderr %q", errs)
+			}
+			if tt.copied == "" {
+				if out != "" {
+					t.Errorf("stdout %q, want nothing", out)
+				}
+			} else if got := copied(t, out); got != tt.copied {
+				t.Errorf("copied %q, want %q", got, tt.copied)
+			}
+		})
+	}
+}
+
+func TestLeadingNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"42 apples", 42},
+		{"  -3.5 below", -3.5},
+		{"10.0.0.2", 10},
+		{"1.2.3", 1.2},
+		{"-", 0},
+		{".", 0},
+		{"v1.2", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := leadingNumber([]byte(tt.in)); got != tt.want {
+			t.Errorf("leadingNumber(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	tests := []struct {
+		name                           string
+		in                             string
+		sorted, numeric, reverse, uniq bool
+		want                           string
+	}{
+		{"sort", "b\na\nc\n", true, false, false, false, "a\nb\nc\n"},
+		{"reverse", "b\na\nc\n", true, false, true, false, "c\nb\na\n"},
+		{"numeric", "10 x\n9 y\n-1 z\nnone\n", true, true, false, false, "-1 z\nnone\n9 y\n10 x\n"},
+		{"numeric reverse", "10\n9\n100\n", true, true, true, false, "100\n10\n9\n"},
+		{"numeric ties by text", "2 b\n2 a\n", true, true, false, false, "2 a\n2 b\n"},
+		{"numeric IPs", "100.1.1.1\n10.0.0.2\n9.0.0.1\n", true, true, false, false, "9.0.0.1\n10.0.0.2\n100.1.1.1\n"},
+		{"numeric versions", "1.10.0\n1.2.3\n0.9\n", true, true, false, false, "0.9\n1.10.0\n1.2.3\n"},
+		{"numeric fractions", "2.5x\n-0.5\n2.25\n", true, true, false, false, "-0.5\n2.25\n2.5x\n"},
+		{"uniq only adjacent", "a\na\nb\na\n", false, false, false, true, "a\nb\na\n"},
+		{"sort uniq", "b\na\nb\na\n", true, false, false, true, "a\nb\n"},
+		{"sort uniq reverse", "b\na\nb\n", true, false, true, true, "b\na\n"},
+		{"no final newline", "b\na", true, false, false, false, "a\nb"},
+		{"crlf", "b\r\na\r\n", true, false, false, false, "a\r\nb\r\n"},
+		{"crlf without final ending", "b\r\na", true, false, false, false, "a\r\nb"},
+		{"mixed endings stay with their lines", "c\r\nb\na\r\n", true, false, false, false, "a\r\nb\nc\r\n"},
+		{"uniq ignores endings", "a\r\na\nb\n", false, false, false, true, "a\r\nb\n"},
+		{"empty", "", true, false, false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(sortLines([]byte(tt.in), tt.sorted, tt.numeric, tt.reverse, tt.uniq)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSort(t *testing.T) {
+	tests := []struct {
+		args       []string
+		in, copied string
+	}{
+		{[]string{"-sort"}, "b\r\na\r\n", "a\r\nb\r\n"},
+		{[]string{"-sort", "-uniq"}, "b\na\nb\n", "a\nb\n"},
+		{[]string{"-reverse"}, "a\nc\nb\n", "c\nb\na\n"},
+		{[]string{"-sort-numeric"}, "10\n9\n", "9\n10\n"},
+		{[]string{"-uniq"}, "a\na\nb\nb\na\n", "a\nb\na\n"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, tt.in, tt.args...)
+			if code != 0 {
+				t.Fatalf("status %d: %s", code, errs)
+			}
+			if got := copied(t, out); got != tt.copied {
+				t.Errorf("copied %q, want %q", got, tt.copied)
+			}
+		})
+	}
+}
+
+func TestRunSortWarnsWhenHuge(t *testing.T) {
+	in := strings.Repeat("line\n", sortWarnBytes/5+1)
+	_, errs, code := runRCP(t, map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(2 * sortWarnBytes)}, in, "-sort", "-uniq")
+	if want := fmt.Sprintf("rcp: sorting %d bytes in memory\n", len(in)); code != 0 || errs != want {
+		t.Errorf("status %d, stderr %q; want %q", code, errs, want)
+	}
+	if _, errs, _ := runRCP(t, nil, "b\na\n", "-uniq"); errs != "" {
+		t.Errorf("small input: stderr %q", errs)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string // every error, in order
+	}{
+		{"c and e", []string{"-c", "-e", "true"}, []string{"-c can't be used with -e"}},
+		{"several conflicts", []string{"-c", "-e", "true", "-img", "-validate", "json"}, []string{
+			"-c can't be used with -e",
+			"-img can't be used with -c",
+			"-img can't be used with -e",
+			"-img can't be used with -validate",
+		}},
+		{"quiet and status", []string{"-q", "-status", "-"}, []string{"-q can't be used with -status"}},
+		{"image and transform", []string{"-img", "-sort", "a.png"}, []string{"-img can't be used with -sort"}},
+		{"detect and validate", []string{"-detect", "-validate", "json"}, []string{"-detect can't be used with -validate"}},
+		{"dry run and retries", []string{"-e", "true", "-e-dry", "-retries", "2"}, []string{"-e-dry can't be used with -retries"}},
+		{"requires", []string{"-bridge-from", "primary", "-"}, []string{"-bridge-from requires -bridge"}},
+		{"requires a chain", []string{"-headers-size", "10", "-"}, []string{"-headers-size requires -headers"}},
+		{"choice", []string{"-escape", "rust", "-"}, []string{`-escape: unknown value "rust" (go, json, shell, python)`}},
+		{"mode with a file", []string{"-inputs", "a,b", "c"}, []string{"-inputs can't be used with a file argument"}},
+		{"conflict and requires together", []string{"-resume", "-c", "-ts-format", "x", "f"}, []string{
+			"-resume can't be used with -c",
+			"-ts-format requires -ts",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, "", tt.args...)
+			if code != 2 || out != "" {
+				t.Errorf("status %d, stdout %q; want 2 and nothing sent", code, out)
+			}
+			want := "rcp: " + strings.Join(tt.want, "\nrcp: ") + "\n"
+			if errs != want {
+				t.Errorf("stderr\n%s\nwant\n%s", errs, want)
+			}
+		})
+	}
+}
+
+// TestPreflightTables checks that the tables only name flags rcp defines.
+func TestPreflightTables(t *testing.T) {
+	names := map[string]bool{}
+	for _, c := range conflictPairs() {
+		names[c[0]], names[c[1]] = true, true
+	}
+	for k, v := range flagRequires {
+		names[k], names[v] = true, true
+	}
+	for k := range flagChoices {
+		names[k] = true
+	}
+	for _, f := range plainDisables {
+		names[f] = true
+	}
+	for name := range names {
+		if _, errs, _ := runRCP(t, nil, "", "-"+name); strings.Contains(errs, "flag provided but not defined") {
+			t.Errorf("-%s is in a preflight table but not defined", name)
+		}
+	}
+}
+
+func TestRtrimLines(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"spaces and tabs", "a  \nb\t\t\nc \t \n", "a\nb\nc\n"},
+		{"blank lines kept", "a\n   \n\t\nb\n", "a\n\n\nb\n"},
+		{"leading and inner space kept", "  a  b  \n", "  a  b\n"},
+		{"crlf", "a \r\nb\t\r\n", "a\r\nb\r\n"},
+		{"no final newline", "a\nb  ", "a\nb"},
+		{"nothing to trim", "a\nb\n", "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(rtrimLines([]byte(tt.in)))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if strings.Count(got, "\n") != strings.Count(tt.in, "\n") {
+				t.Errorf("line count changed: %q", got)
+			}
+		})
+	}
+}
+
+func TestRunRtrimLines(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "x = 1;  \n\t\n}\t\n", "-rtrim-lines")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	if got := copied(t, out); got != "x = 1;\n\n}\n" {
+		t.Errorf("copied %q", got)
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"RCOPY_MAX_BYTES": "30", "XDG_STATE_HOME": filepath.Join(dir, "state")}
+	var content strings.Builder
+	for i := range 10 {
+		fmt.Fprintf(&content, "line %d\n", i) // 7 bytes each
+	}
+	big := writeFile(t, dir, "big.txt", content.String())
+
+	// Each run copies the next whole lines that fit, starting where the last
+	// one stopped.
+	want := []struct{ copied, status string }{
+		{"line 0\nline 1\nline 2\nline 3\n", "Copied bytes 0-28 of " + big + "; run rcp -resume " + big + " again for the next piece\n"},
+		{"line 4\nline 5\nline 6\nline 7\n", "Copied bytes 28-56 of " + big + "; run rcp -resume " + big + " again for the next piece\n"},
+		{"line 8\nline 9\n", "Copied bytes 56-70 of " + big + "; that was the last piece\n"},
+		{"line 0\nline 1\nline 2\nline 3\n", "Copied bytes 0-28 of " + big + "; run rcp -resume " + big + " again for the next piece\n"},
+	}
+	for i, w := range want {
+		out, errs, code := runRCP(t, env, "", "-resume", "-status", big)
+		if code != 0 {
+			t.Fatalf("run %d: status %d: %s", i+1, code, errs)
+		}
+		if got := copied(t, out); got != w.copied {
+			t.Errorf("run %d copied %q, want %q", i+1, got, w.copied)
+		}
+		if !strings.HasSuffix(errs, "via OSC52\n"+w.status) {
+			t.Errorf("run %d stderr %q, want it to end %q", i+1, errs, w.status)
+		}
+	}
+
+	// A changed file starts over.
+	if err := os.WriteFile(big, []byte("new 0\n"+content.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, _ := runRCP(t, env, "", "-resume", big)
+	if got := copied(t, out); got != "new 0\nline 0\nline 1\nline 2\n" {
+		t.Errorf("after a change copied %q", got)
+	}
+	if !strings.Contains(errs, big+" changed since the last -resume; starting over") {
+		t.Errorf("after a change stderr %q", errs)
+	}
+}
+
+func TestRunResumeHost(t *testing.T) {
+	dir := t.TempDir()
+	header := hostHeader(false)
+	limit := len(header) + 20
+	env := map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(limit), "XDG_STATE_HOME": filepath.Join(dir, "state")}
+	big := writeFile(t, dir, "big.txt", strings.Repeat("abcd\n", 20))
+
+	out, errs, code := runRCP(t, env, "", "-resume", "-host", big)
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	if got, want := copied(t, out), header+strings.Repeat("abcd\n", 4); got != want {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+
+	env["RCOPY_MAX_BYTES"] = strconv.Itoa(len(header) - 1)
+	if _, errs, code := runRCP(t, env, "", "-resume", "-host", big); code != 1 || !strings.Contains(errs, "the -host header alone exceeds limit") {
+		t.Errorf("tiny limit: status %d, stderr %q", code, errs)
+	}
+	if _, errs, code := runRCP(t, env, "", "-resume", "-ts", big); code != 2 || !strings.Contains(errs, "-resume can't be used with -ts") {
+		t.Errorf("-ts: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunExecSep(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"default", []string{"-e", "echo hi"}, nil, "echo hi\nhi\n", "", 0},
+		{"custom", []string{"-e", "echo hi", "-e-sep", `\n---\n`}, nil, "echo hi\n---\nhi\n", "", 0},
+		{"escapes", []string{"-e", "echo hi", "-e-sep", `\t=>\t`}, nil, "echo hi\t=>\thi\n", "", 0},
+		{"empty", []string{"-e", "echo hi", "-e-sep", ""}, nil, "echo hihi\n", "", 0},
+		{"fits the limit exactly", []string{"-e", "echo hi", "-e-sep", `\n---\n`}, map[string]string{"RCOPY_MAX_BYTES": "15"}, "echo hi\n---\nhi\n", "", 0},
+		{"counts against the limit", []string{"-e", "echo hi", "-e-sep", `\n---\n`}, map[string]string{"RCOPY_MAX_BYTES": "11"}, "", "exceeds limit 11. Refusing.", 1},
+		{"without -e", []string{"-e-sep", "x", "-"}, nil, "", "rcp: -e-sep requires -e", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, "", tt.args...)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while rcp writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runPass runs rcp -pass with the given stdin, keeping stdout apart from the
+// terminal.
+func runPass(t *testing.T, env map[string]string, in io.Reader, term io.Writer, args ...string) (string, string, int) {
+	t.Helper()
+	vars := map[string]string{"PATH": os.Getenv("PATH"), "HOME": t.TempDir()}
+	for k, v := range env {
+		vars[k] = v
+	}
+	var out syncBuffer
+	var errb strings.Builder
+	code := run(append([]string{"-pass"}, args...), in, &out, &errb, term, func(k string) string { return vars[k] })
+	return out.String(), errb.String(), code
+}
+
+func TestRunPass(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		in     string
+		copied string // "" means nothing may be sent
+		code   int
+	}{
+		{"text", nil, nil, "hello\nworld\n", "hello\nworld\n", 0},
+		{"exact bytes", nil, nil, "a\r\nb\x00\xff\tno newline", "a\r\nb\x00\xff\tno newline", 0},
+		{"transforms only touch the copy", []string{"-sort"}, nil, "b\na\n", "a\nb\n", 0},
+		{"over the limit", nil, map[string]string{"RCOPY_MAX_BYTES": "4"}, "0123456789", "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := newFakeTerm(t, nil)
+			out, errs, code := runPass(t, tt.env, strings.NewReader(tt.in), term, tt.args...)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (stderr %q)", code, tt.code, errs)
+			}
+			if out != tt.in {
+				t.Errorf("stdout %q, want the input %q", out, tt.in)
+			}
+			if tt.copied == "" {
+				if term.String() != "" {
+					t.Errorf("terminal got %q, want nothing", term.String())
+				}
+			} else if got := copied(t, term.String()); got != tt.copied {
+				t.Errorf("copied %q, want %q", got, tt.copied)
+			}
+		})
+	}
+}
+
+func TestRunPassStreams(t *testing.T) {
+	pr, pw := io.Pipe()
+	term := newFakeTerm(t, nil)
+	var out syncBuffer
+	done := make(chan int)
+	go func() {
+		done <- run([]string{"-pass"}, pr, &out, io.Discard, term, func(string) string { return "" })
+	}()
+	pw.Write([]byte("first\n"))
+	// The first line reaches stdout while stdin is still open.
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() != "first\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("stdout %q before stdin closed, want %q", out.String(), "first\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pw.Write([]byte("second\n"))
+	pw.Close()
+	if code := <-done; code != 0 {
+		t.Fatalf("status %d", code)
+	}
+	if got := copied(t, term.String()); got != "first\nsecond\n" {
+		t.Errorf("copied %q", got)
+	}
+}
+
+func TestRunPassNeedsTerminal(t *testing.T) {
+	out, errs, code := runPass(t, nil, strings.NewReader("x"), nil)
+	if code != 1 || out != "" || !strings.Contains(errs, "rcp: -pass needs a terminal") {
+		t.Errorf("status %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// fdSource returns a /dev/fd path that reads content from a pipe, like the
+// shell's <(...).
+func fdSource(t *testing.T, content string) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	go func() {
+		w.WriteString(content)
+		w.Close()
+	}()
+	return fmt.Sprintf("/dev/fd/%d", r.Fd())
+}
+
+func TestRunInputs(t *testing.T) {
+	if _, err := os.Stat("/dev/fd/0"); err != nil {
+		t.Skip("no /dev/fd")
+	}
+	dir := t.TempDir()
+	file := writeFile(t, dir, "c.txt", "from a file\n")
+	tests := []struct {
+		name   string
+		args   func() []string
+		env    map[string]string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"two pipes in order", func() []string {
+			return []string{"-inputs", fdSource(t, "one\n") + "," + fdSource(t, "two\n")}
+		}, nil, "one\ntwo\n", "", 0},
+		{"pipes and a file", func() []string {
+			return []string{"-inputs", file + "," + fdSource(t, "piped")}
+		}, nil, "from a file\npiped", "", 0},
+		{"labels", func() []string {
+			return []string{"-inputs", "first=" + fdSource(t, "one") + ",second=" + fdSource(t, "two\n")}
+		}, nil, "==> first <==\none\n==> second <==\ntwo\n", "", 0},
+		{"headers name unlabeled entries", func() []string {
+			return []string{"-inputs", file, "-headers"}
+		}, nil, "==> " + file + " <==\nfrom a file\n", "", 0},
+		{"limit covers them all", func() []string {
+			return []string{"-inputs", fdSource(t, "12345") + "," + fdSource(t, "67890")}
+		}, map[string]string{"RCOPY_MAX_BYTES": "8"}, "", "exceeds limit 8. Refusing.", 1},
+		{"missing entry", func() []string {
+			return []string{"-inputs", file + "," + filepath.Join(dir, "nope")}
+		}, nil, "", "rcp: not a file: " + filepath.Join(dir, "nope"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, "", tt.args()...)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestRunMap(t *testing.T) {
+	dir := t.TempDir()
+	one := writeFile(t, dir, "one.txt", "first snippet\n")
+	two := writeFile(t, dir, "two.txt", "second snippet\n")
+	colon := writeFile(t, dir, "a:b.txt", "colon in the name\n")
+
+	term := newFakeTerm(t, map[string]string{"c": "old clipboard", "p": "old primary"})
+	_, errs, code := runTerm(t, term, nil, "", "-status", "-map", one+":c,"+two+":p,"+colon+":1")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	for sel, want := range map[string]string{"c": "first snippet\n", "p": "second snippet\n", "1": "colon in the name\n"} {
+		if got := term.selection(sel); got != want {
+			t.Errorf("selection %s holds %q, want %q", sel, got, want)
+		}
+	}
+	// One sequence per file, in the order given.
+	ws := osc52Writes(t, term.String())
+	if len(ws) != 3 || ws[0].sel != "c" || ws[1].sel != "p" || ws[2].sel != "1" {
+		t.Errorf("sequences %q, want c, p, 1 in order", ws)
+	}
+	wantStatus := "Sent 14 bytes of " + one + " to selection c via OSC52\n" +
+		"Sent 15 bytes of " + two + " to selection p via OSC52\n" +
+		"Sent 18 bytes of " + colon + " to selection 1 via OSC52\n"
+	if errs != wantStatus {
+		t.Errorf("stderr %q, want %q", errs, wantStatus)
+	}
+
+	tests := []struct {
+		name   string
+		spec   string
+		env    map[string]string
+		stderr string
+		code   int
+	}{
+		{"bad selection", one + ":x", nil, `-map: bad entry "` + one + `:x"`, 2},
+		{"no selection", one, nil, "-map: bad entry", 2},
+		{"missing file", filepath.Join(dir, "nope") + ":c", nil, "rcp: not a file: ", 1},
+		{"over the limit", one + ":c", map[string]string{"RCOPY_MAX_BYTES": "5"}, "exceeds limit 5", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, "", "-map", tt.spec)
+			checkRun(t, out, errs, code, "", tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	pic := tinyPNG(t)
+	tests := []struct {
+		name, file, content, want string
+	}{
+		{"png", "dot.png", string(pic), "data:image/png;base64," + base64.StdEncoding.EncodeToString(pic)},
+		{"png without an extension", "dot", string(pic), "data:image/png;base64," + base64.StdEncoding.EncodeToString(pic)},
+		{"text", "note.txt", "hi\n", "data:text/plain;charset=utf-8;base64,aGkK"},
+		{"css", "a.css", "p{}", "data:text/css;charset=utf-8;base64,cHt9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dataURI(tt.file, []byte(tt.content)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunDataURI(t *testing.T) {
+	dir := t.TempDir()
+	pic := tinyPNG(t)
+	pngFile := writeFile(t, dir, "dot.png", string(pic))
+	textFile := writeFile(t, dir, "note.txt", "hi\n")
+	bigFile := writeFile(t, dir, "big.bin", strings.Repeat("x", dataURIMaxBytes+1))
+	tests := []struct {
+		name, file, copied, stderr string
+		code                       int
+	}{
+		{"png", pngFile, "data:image/png;base64," + base64.StdEncoding.EncodeToString(pic), "", 0},
+		{"text", textFile, "data:text/plain;charset=utf-8;base64,aGkK", "", 0},
+		{"over the cap", bigFile, "", fmt.Sprintf("rcp: -data-uri: %s is %d bytes; data URIs are capped at %d. Refusing.", bigFile, dataURIMaxBytes+1, dataURIMaxBytes), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, "", "-data-uri", tt.file)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestDescribeContent(t *testing.T) {
+	report := func(bytes, lines int, endings, utf8, bom, binary string) string {
+		return fmt.Sprintf("Bytes:        %d\nLines:        %d\nLine endings: %s\nValid UTF-8:  %s\nBOM:          %s\nBinary:       %s\n",
+			bytes, lines, endings, utf8, bom, binary)
+	}
+	tests := []struct {
+		name, in, want string
+	}{
+		{"lf", "a\nb\n", report(4, 2, "LF", "yes", "no", "no")},
+		{"crlf", "a\r\nb\r\n", report(6, 2, "CRLF", "yes", "no", "no")},
+		{"mixed", "\xef\xbb\xbfa\nb\r\nc", report(9, 3, "mixed (1 LF, 1 CRLF)", "yes", "yes", "no")},
+		{"no endings", "abc", report(3, 1, "none", "yes", "no", "no")},
+		{"empty", "", report(0, 0, "none", "yes", "no", "no")},
+		{"invalid utf-8", "caf\xe9\n", report(5, 1, "LF", "no", "no", "no")},
+		{"nul byte", "a\x00b", report(3, 1, "none", "yes", "no", "yes")},
+		{"control characters", "\x01\x02\x03abcdefg", report(10, 1, "none", "yes", "no", "yes")},
+		{"escapes are text", "\x1b[31mred\x1b[0m\n", report(13, 1, "LF", "yes", "no", "no")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			describeContent(&buf, []byte(tt.in))
+			if buf.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunDetect(t *testing.T) {
+	dir := t.TempDir()
+	big := writeFile(t, dir, "big.txt", strings.Repeat("line\r\n", 100))
+	out, errs, code := runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "100"}, "", "-detect", big)
+	if code != 0 || out != "" {
+		t.Errorf("status %d, stdout %q; want 0 and nothing copied", code, out)
+	}
+	if !strings.HasPrefix(errs, "Bytes:        600\nLines:        100\nLine endings: CRLF\n") {
+		t.Errorf("report %q", errs)
+	}
+
+	out, errs, code = runRCP(t, nil, "a\nb\r\n", "-detect")
+	if code != 0 || out != "" || !strings.Contains(errs, "Line endings: mixed (1 LF, 1 CRLF)\n") {
+		t.Errorf("stdin: status %d, stdout %q, report %q", code, out, errs)
+	}
+}
+
+// pacedReader returns a reader that yields each of parts in turn, pausing
+// between them.
+func pacedReader(pause time.Duration, parts ...string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for i, p := range parts {
+			if i > 0 {
+				time.Sleep(pause)
+			}
+			pw.Write([]byte(p))
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+func TestFollowTail(t *testing.T) {
+	tests := []struct {
+		name  string
+		max   int
+		parts []string
+		want  []string
+	}{
+		{"one emission per pause", 100, []string{"a\n", "b\nc\n", "d\n"}, []string{"a\n", "a\nb\nc\n", "a\nb\nc\nd\n"}},
+		{"window keeps the tail at a line boundary", 5, []string{"a\n", "b\nc\n", "dd\n"}, []string{"a\n", "b\nc\n", "c\ndd\n"}},
+		{"a partial line is sent at eof", 100, []string{"a\n", "b"}, []string{"a\n", "a\nb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := followTail(pacedReader(300*time.Millisecond, tt.parts...), tt.max, 50*time.Millisecond, 0, func(b []byte) {
+				got = append(got, string(b))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("emitted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFollowTailMaxWait(t *testing.T) {
+	// Input never pauses for quiet, so only maxWait gets it sent before EOF.
+	parts := make([]string, 30)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%d\n", i)
+	}
+	var got []string
+	err := followTail(pacedReader(10*time.Millisecond, parts...), 1000, time.Second, 100*time.Millisecond, func(b []byte) {
+		got = append(got, string(b))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 2 || got[len(got)-1] != strings.Join(parts, "") {
+		t.Errorf("emitted %q, want several updates ending with everything", got)
+	}
+}
+
+func TestRunFollow(t *testing.T) {
+	term := newFakeTerm(t, nil)
+	var errb strings.Builder
+	env := map[string]string{"RCOPY_MAX_BYTES": "8"}
+	code := run([]string{"-follow", "-quiet-interval", "50ms", "-status"}, pacedReader(300*time.Millisecond, "one\n", "two\n", "three\n"),
+		term, &errb, term, func(k string) string { return env[k] })
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errb.String())
+	}
+	var got []string
+	for _, w := range osc52Writes(t, term.String()) {
+		got = append(got, w.data)
+	}
+	// The clipboard holds the last 8 bytes, from a line boundary on.
+	want := []string{"one\n", "one\ntwo\n", "three\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if n := strings.Count(errb.String(), "via OSC52\n"); n != 3 {
+		t.Errorf("%d status lines in %q, want 3", n, errb.String())
+	}
+}
+
+func TestRunFollowHost(t *testing.T) {
+	header := hostHeader(false)
+	term := newFakeTerm(t, nil)
+	var errb strings.Builder
+	env := map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(len(header) + 8)}
+	code := run([]string{"-follow", "-host", "-quiet-interval", "50ms"}, pacedReader(300*time.Millisecond, "one\n", "two\n", "three\n"),
+		term, &errb, term, func(k string) string { return env[k] })
+	if code != 0 || errb.Len() != 0 {
+		t.Fatalf("status %d: %s", code, errb.String())
+	}
+	var got []string
+	for _, w := range osc52Writes(t, term.String()) {
+		got = append(got, w.data)
+	}
+	// The window leaves room for the header, so no update is skipped.
+	want := []string{header + "one\n", header + "one\ntwo\n", header + "three\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	out, errs, code := runRCP(t, map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(len(header))}, "x\n", "-follow", "-host")
+	checkRun(t, out, errs, code, "", "the -host header alone exceeds limit", 1)
+}
+
+func TestRunPlain(t *testing.T) {
+	const in = "b  \r\n# comment ~/x ${X} \"q\"\na\\\n\n\n\xff\x00 https://example.com"
+	transforms := [][]string{
+		{"-sort", "-uniq", "-reverse"},
+		{"-sort-numeric"},
+		{"-rtrim-lines", "-collapse-blank", "-tidy"},
+		{"-strip-comments", "hash"},
+		{"-strip-quotes", "-per-line"},
+		{"-strip-prompt", "-prompt-regex", "^b"},
+		{"-join-continuations", "-unwrap", "-unwrap-space"},
+		{"-interp", "-var", "X=1", "-interp-strict"},
+		{"-urls", "-urls-unique"},
+		{"-mask", "a"},
+		{"-tilde", "-tilde-env"},
+		{"-escape", "go"},
+		{"-ts", "-ts-format", "15:04"},
+		{"-data-uri"},
+		{"-validate", "json", "-pretty"},
+		// Options of a disabled transform are ignored, not refused.
+		{"-var", "X=1"},
+		{"-per-line"},
+		{"-ts-format", "15:04"},
+		{"-tilde-env", "-unwrap-space", "-interp-strict", "-prompt-regex", "x", "-urls-unique"},
+	}
+	for _, flags := range transforms {
+		t.Run(strings.Join(flags, " "), func(t *testing.T) {
+			out, errs, code := runRCP(t, nil, in, append([]string{"-plain"}, flags...)...)
+			if strings.Contains(strings.Join(flags, " "), "-validate") {
+				// -validate is a check, not a transform, and still runs.
+				if code != 1 || !strings.Contains(errs, "invalid JSON") {
+					t.Errorf("status %d, stderr %q; want -validate to refuse", code, errs)
+				}
+				return
+			}
+			checkRun(t, out, errs, code, in, "", 0)
+		})
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	dir := t.TempDir()
+	// flaky fails until its third run.
+	flaky := "n=$(($(cat " + dir + "/count 2>/dev/null || echo 0) + 1)); echo $n > " + dir + "/count; echo attempt $n; [ $n -ge 3 ]"
+	tests := []struct {
+		name    string
+		args    []string
+		copied  string
+		retried int // "retry" lines on stderr
+		code    int
+	}{
+		{"succeeds on the third try", []string{"-retries", "2"}, flaky + "\nattempt 3\n", 2, 0},
+		{"runs out of retries", []string{"-retries", "1"}, "", 1, 1},
+		{"no retries", nil, "", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "count"))
+			args := []string{"-e", flaky}
+			if tt.args != nil {
+				args = append(append(args, "-retry-delay", "1ms"), tt.args...)
+			}
+			out, errs, code := runRCP(t, nil, "", args...)
+			wantErr := "rcp: command failed (exit status 1); retry 2 of 2 in 1ms\n"
+			if tt.code != 0 {
+				wantErr = "exit status 1\n"
+			}
+			checkRun(t, out, errs, code, tt.copied, wantErr, tt.code)
+			if n := strings.Count(errs, "rcp: command failed (exit status 1); retry "); n != tt.retried {
+				t.Errorf("%d retries in %q, want %d", n, errs, tt.retried)
+			}
+			b, _ := os.ReadFile(filepath.Join(dir, "count"))
+			if runs, want := strings.TrimSpace(string(b)), strconv.Itoa(tt.retried+1); runs != want {
+				t.Errorf("command ran %s times, want %s", runs, want)
+			}
+		})
+	}
+}
+
+func TestRunHost(t *testing.T) {
+	name, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	header := "# host: " + name + "\n"
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"host", []string{"-host"}, nil, header + "body\n", "", 0},
+		{"host and user", []string{"-host", "-host-user"}, nil, "# host: " + name + " user: " + u.Username + "\nbody\n", "", 0},
+		{"off", nil, nil, "body\n", "", 0},
+		{"with the command", []string{"-host", "-e", "echo body"}, nil, header + "echo body\nbody\n", "", 0},
+		{"counts against the limit", []string{"-host"}, map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(len(header) + 4)}, "", "exceeds limit", 1},
+		{"fits the limit exactly", []string{"-host"}, map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(len(header) + 5)}, header + "body\n", "", 0},
+		{"user needs host", []string{"-host-user"}, nil, "", "rcp: -host-user requires -host", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, "body\n", tt.args...)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestCollapseBlank(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"doubled newlines", "a\n\nb\n\nc\n", "a\n\nb\n\nc\n"},
+		{"runs of blank lines", "a\n\n\n\nb\n\n\nc\n", "a\n\nb\n\nc\n"},
+		{"whitespace-only lines are blank", "a\n  \n\t\n\nb\n", "a\n  \nb\n"},
+		{"leading and trailing runs", "\n\n\na\n\n\n", "\na\n\n"},
+		{"crlf", "a\r\n\r\n\r\nb\r\n", "a\r\n\r\nb\r\n"},
+		{"nothing to do", "a\nb\n", "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(collapseBlank([]byte(tt.in))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCollapseBlank(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "a\n\n\n\nb\n", "-collapse-blank")
+	checkRun(t, out, errs, code, "a\n\nb\n", "", 0)
+}
+
+func TestRunVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		keep   func(string) string
+		mute   bool
+		stderr string
+		code   int
+	}{
+		{"match", nil, false, "Verified: clipboard matches\n", 0},
+		{"mismatch", func(string) string { return "something else" }, false, "rcp: -verify: clipboard holds 14 bytes that differ from the 12 sent\n", 1},
+		{"truncated", func(s string) string { return s[:5] }, false, "rcp: -verify: clipboard holds only the first 5 of 12 bytes (truncated by the terminal?)\n", 1},
+		{"no response", nil, true, "rcp: -verify: no reply from terminal (OSC52 reads may be disabled)\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := newFakeTerm(t, nil)
+			term.keep, term.mute = tt.keep, tt.mute
+			_, errs, code := runTerm(t, term, nil, "hello world\n", "-verify", "-status")
+			if code != tt.code {
+				t.Errorf("status %d, want %d", code, tt.code)
+			}
+			if want := "Sent 12 bytes via OSC52\n" + tt.stderr; errs != want {
+				t.Errorf("stderr %q, want %q", errs, want)
+			}
+			if term.reads != 1 {
+				t.Errorf("%d clipboard reads, want 1", term.reads)
+			}
+		})
+	}
+
+	_, errs, code := runRCP(t, nil, "x", "-verify")
+	if code != 1 || !strings.Contains(errs, "rcp: -verify: no terminal to ask") {
+		t.Errorf("without a terminal: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunHeaders(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", "alpha\n")
+	b := writeFile(t, dir, "b.txt", "beta") // no final newline
+	c := writeFile(t, dir, "c.txt", "gamma\n")
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"a banner before each file", []string{"-inputs", a + "," + b + "," + c, "-headers"}, nil,
+			"==> " + a + " <==\nalpha\n==> " + b + " <==\nbeta\n==> " + c + " <==\ngamma\n", "", 0},
+		{"order follows the list", []string{"-inputs", c + "," + a, "-headers"}, nil,
+			"==> " + c + " <==\ngamma\n==> " + a + " <==\nalpha\n", "", 0},
+		{"sizes", []string{"-inputs", a + "," + b, "-headers", "-headers-size"}, nil,
+			"==> " + a + " (6 bytes) <==\nalpha\n==> " + b + " (4 bytes) <==\nbeta", "", 0},
+		{"labels win over paths", []string{"-inputs", "first=" + a + "," + b, "-headers"}, nil,
+			"==> first <==\nalpha\n==> " + b + " <==\nbeta", "", 0},
+		{"no headers", []string{"-inputs", a + "," + b}, nil, "alpha\nbeta", "", 0},
+		{"banners count against the limit", []string{"-inputs", a + "," + b, "-headers"},
+			map[string]string{"RCOPY_MAX_BYTES": "20"}, "", "exceeds limit 20", 1},
+		{"headers need inputs", []string{"-headers", a}, nil, "", "rcp: -headers requires -inputs", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, tt.env, "", tt.args...)
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+		})
+	}
+}
+
+func TestRunPasteService(t *testing.T) {
+	type request struct {
+		method, ctype, auth, body string
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		status int
+		reply  string
+		want   request
+		copied string
+		stderr string
+		code   int
+	}{
+		{"raw", nil, nil, 200, "https://paste.example/abc\n",
+			request{"POST", "text/plain; charset=utf-8", "", "secret log\n"}, "https://paste.example/abc", "", 0},
+		{"form", []string{"-paste-format", "form", "-paste-field", "text"}, nil, 201, "https://paste.example/f",
+			request{"POST", "application/x-www-form-urlencoded", "", "text=secret+log%0A"}, "https://paste.example/f", "", 0},
+		{"json", []string{"-paste-format", "json"}, nil, 200, `{"url": "https://paste.example/j", "id": 7}`,
+			request{"POST", "application/json", "", `{"content":"secret log\n"}`}, "https://paste.example/j", "", 0},
+		{"auth header", nil, map[string]string{"RCOPY_PASTE_AUTH": "Authorization: Bearer t0k"}, 200, "https://paste.example/a",
+			request{"POST", "text/plain; charset=utf-8", "Bearer t0k", "secret log\n"}, "https://paste.example/a", "", 0},
+		{"server error", nil, nil, 500, "disk full",
+			request{"POST", "text/plain; charset=utf-8", "", "secret log\n"}, "", "rcp: -paste-service: 500 Internal Server Error: disk full\n", 1},
+		{"empty reply", nil, nil, 200, "",
+			request{"POST", "text/plain; charset=utf-8", "", "secret log\n"}, "", "rcp: -paste-service: empty reply\n", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = request{r.Method, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(b)}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.reply)
+			}))
+			defer srv.Close()
+			out, errs, code := runRCP(t, tt.env, "secret log\n", append([]string{"-paste-service", srv.URL, "-status"}, tt.args...)...)
+			if tt.code == 0 {
+				// The link is reported with the status lines as well as copied.
+				tt.stderr = "Pasted 11 bytes to " + tt.copied + "\n"
+			}
+			checkRun(t, out, errs, code, tt.copied, tt.stderr, tt.code)
+			if got != tt.want {
+				t.Errorf("request %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Like other success messages, the link line obeys -q.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "https://paste.example/q")
+	}))
+	defer srv.Close()
+	out, errs, code := runRCP(t, nil, "x", "-paste-service", srv.URL, "-q")
+	checkRun(t, out, errs, code, "https://paste.example/q", "", 0)
+
+	_, errs, code = runRCP(t, map[string]string{"RCOPY_PASTE_AUTH": "no colon"}, "x", "-paste-service", "http://127.0.0.1:1/")
+	if code != 1 || !strings.Contains(errs, `RCOPY_PASTE_AUTH must look like "Name: value"`) {
+		t.Errorf("bad auth: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunAutoMax(t *testing.T) {
+	big := strings.Repeat("x", 200000) // over the default limit
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		in     string
+		copied string
+		stderr string
+		code   int
+	}{
+		{"kitty", map[string]string{"TERM": "xterm-kitty"}, nil, big, big, "", 0},
+		{"unknown terminal", map[string]string{"TERM": "xterm"}, nil, big, "", "exceeds limit 74994", 1},
+		{"unknown terminal, small copy", map[string]string{"TERM": "xterm"}, nil, "hi", "hi", "", 0},
+		{"with the limit set", map[string]string{"TERM": "xterm-kitty", "RCOPY_MAX_BYTES": "10"}, nil, "0123456789abc", "", "exceeds limit 10", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := newFakeTerm(t, map[string]string{"c": "precious"})
+			_, errs, code := runTerm(t, term, tt.env, tt.in, append([]string{"-auto-max"}, tt.args...)...)
+			if code != tt.code {
+				t.Fatalf("status %d, want %d (stderr %q)", code, tt.code, errs)
+			}
+			if tt.stderr == "" && errs != "" || !strings.Contains(errs, tt.stderr) {
+				t.Errorf("stderr %q, want %q", errs, tt.stderr)
+			}
+			var got []string
+			for _, w := range osc52Writes(t, term.String()) {
+				got = append(got, w.data)
+			}
+			// Read, probe, read back, restore; then the copy itself.
+			want := []string{"?", "rcp-probe", "?", "precious"}
+			if tt.env["RCOPY_MAX_BYTES"] != "" {
+				want = nil
+			}
+			if tt.copied != "" {
+				want = append(want, tt.copied)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("terminal got %.60q, want %.60q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunAutoMaxNoProbe(t *testing.T) {
+	for _, args := range [][]string{
+		{"-auto-max", "-nope"},
+		{"-auto-max", "-c", "-e", "true"},
+		{"-auto-max", "-peek"},
+		{"-auto-max", "-promote"},
+		{"-auto-max", "-detect", "-"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			term := newFakeTerm(t, map[string]string{"c": "precious"})
+			_, errs, code := runTerm(t, term, map[string]string{"TERM": "xterm-kitty"}, "x", args...)
+			if code != 2 {
+				t.Errorf("status %d, want 2 (stderr %q)", code, errs)
+			}
+			if term.String() != "" {
+				t.Errorf("terminal got %q, want nothing", term.String())
+			}
+		})
+	}
+}
+
+func TestRunAutoMaxProbeFails(t *testing.T) {
+	term := newFakeTerm(t, map[string]string{"c": "precious"})
+	term.mute = true
+	_, errs, code := runTerm(t, term, map[string]string{"TERM": "xterm-kitty"}, "hi", "-auto-max")
+	if code != 0 || !strings.Contains(errs, "rcp: -auto-max: probe failed (no reply from terminal") || !strings.Contains(errs, "using the default limit 100000") {
+		t.Errorf("status %d, stderr %q", code, errs)
+	}
+	// Only the first read went out: nothing was written before it failed.
+	if got := osc52Writes(t, term.String()); len(got) != 2 || got[0].data != "?" || got[1].data != "hi" {
+		t.Errorf("terminal got %q", got)
+	}
+}
+
+func TestRunExecDry(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+	cmd := "touch " + marker + " && echo done"
+	out, errs, code := runRCP(t, nil, "", "-e", cmd, "-e-dry")
+	checkRun(t, out, errs, code, cmd, "", 0)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the command ran")
+	}
+
+	out, errs, code = runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "5"}, "", "-e", cmd, "-e-dry")
+	checkRun(t, out, errs, code, "", "exceeds limit 5", 1)
+
+	for _, extra := range [][]string{{"-e-sep", "x"}, {"-retries", "1"}, {"-e-stream"}} {
+		_, errs, code := runRCP(t, nil, "", append([]string{"-e", cmd, "-e-dry"}, extra...)...)
+		if want := "rcp: -e-dry can't be used with " + extra[0]; code != 2 || !strings.Contains(errs, want) {
+			t.Errorf("%s: status %d, stderr %q", extra[0], code, errs)
+		}
+	}
+}
+
+func TestRunCleanEnv(t *testing.T) {
+	env := map[string]string{"HOME": "/home/u", "TERM": "xterm", "LANG": "C.UTF-8", "AWS_SECRET_ACCESS_KEY": "s3cr3t", "FOO": "foo", "BAR": "bar"}
+	// bash sets PWD, SHLVL and _ itself.
+	const listEnv = "env | cut -d= -f1 | grep -vx 'PWD\\|SHLVL\\|_\\|OLDPWD' | sort"
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"essentials only", []string{"-clean-env"}, []string{"HOME", "LANG", "PATH", "TERM"}},
+		{"kept variables", []string{"-clean-env", "-keep-env", "FOO", "-keep-env", "BAR"}, []string{"BAR", "FOO", "HOME", "LANG", "PATH", "TERM"}},
+		{"kept but unset", []string{"-clean-env", "-keep-env", "NOPE"}, []string{"HOME", "LANG", "PATH", "TERM"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, errs, code := runRCP(t, env, "", append(tt.args, "-e", listEnv)...)
+			checkRun(t, out, errs, code, listEnv+"\n"+strings.Join(tt.want, "\n")+"\n", "", 0)
+		})
+	}
+
+	out, errs, code := runRCP(t, env, "", "-clean-env", "-e", "echo $HOME:$FOO:$AWS_SECRET_ACCESS_KEY")
+	checkRun(t, out, errs, code, "echo $HOME:$FOO:$AWS_SECRET_ACCESS_KEY\n/home/u::\n", "", 0)
+
+	// Without -clean-env the command inherits rcp's own environment.
+	t.Setenv("RCP_TEST_INHERITED", "yes")
+	out, errs, code = runRCP(t, nil, "", "-e", "echo $RCP_TEST_INHERITED")
+	checkRun(t, out, errs, code, "echo $RCP_TEST_INHERITED\nyes\n", "", 0)
+
+	if _, errs, code := runRCP(t, nil, "", "-keep-env", "FOO", "-e", "true"); code != 2 || !strings.Contains(errs, "-keep-env requires -clean-env") {
+		t.Errorf("-keep-env alone: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunRecord(t *testing.T) {
+	setNow(t, time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC))
+	dir := t.TempDir()
+
+	raw := filepath.Join(dir, "raw.rec")
+	out1, errs, code := runRCP(t, nil, "one\n", "-record", raw, "-raw")
+	checkRun(t, out1, errs, code, "one\n", "", 0)
+	out2, _, _ := runRCP(t, nil, "two\n", "-record", raw, "-raw")
+	// The file holds exactly what was emitted, run after run.
+	if b, _ := os.ReadFile(raw); string(b) != out1+out2 {
+		t.Errorf("raw record %q, want %q", b, out1+out2)
+	}
+
+	headed := filepath.Join(dir, "headed.rec")
+	out, errs, code := runRCP(t, nil, "hi", "-record", headed)
+	checkRun(t, out, errs, code, "hi", "", 0)
+	want := fmt.Sprintf("# rcp 2024-05-06T07:08:09Z, %d bytes\n%s\n", len(out), out)
+	if b, _ := os.ReadFile(headed); string(b) != want {
+		t.Errorf("record %q, want %q", b, want)
+	}
+
+	// With screen's chunked form, every byte written is recorded.
+	chunked := filepath.Join(dir, "chunked.rec")
+	out, _, _ = runRCP(t, map[string]string{"STY": "1.pts"}, strings.Repeat("x", 1000), "-record", chunked, "-raw")
+	if b, _ := os.ReadFile(chunked); !strings.HasPrefix(out, "\033P") || string(b) != out {
+		t.Errorf("chunked record differs from the %d bytes emitted", len(out))
+	}
+
+	_, errs, code = runRCP(t, nil, "x", "-record", filepath.Join(dir, "no", "such", "dir"))
+	if code != 1 || !strings.Contains(errs, "rcp: -record: ") {
+		t.Errorf("unwritable: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestStripPrompt(t *testing.T) {
+	def := regexp.MustCompile(defaultPromptRegex)
+	tests := []struct {
+		name, in, want string
+		re             *regexp.Regexp
+	}{
+		{"dollar", "$ ls -l\ntotal 0\n", "ls -l\ntotal 0\n", def},
+		{"user at host", "alice@web01:~/src$ make\nok\n", "make\nok\n", def},
+		{"user at host without a dir", "bob@db-2.prod$ uptime\n", "uptime\n", def},
+		{"bracketed", "[alice@web01 src]$ git status\n", "git status\n", def},
+		{"root and zsh", "# whoami\n% echo hi\n> continued\n", "whoami\necho hi\ncontinued\n", def},
+		{"output left alone", "cost: $5\nx $ y\n", "cost: $5\nx $ y\n", def},
+		{"only the first prompt", "$ echo '$ nested'\n", "echo '$ nested'\n", def},
+		{"crlf", "$ ls\r\nfile\r\n", "ls\r\nfile\r\n", def},
+		{"custom", "PS> Get-Item\nPS> dir\n", "Get-Item\ndir\n", regexp.MustCompile(`^PS> `)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripPrompt([]byte(tt.in), tt.re)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunStripPrompt(t *testing.T) {
+	transcript := "$ echo hi\nhi\nalice@box:~$ pwd\n/home/alice\n"
+	out, errs, code := runRCP(t, nil, transcript, "-strip-prompt")
+	checkRun(t, out, errs, code, "echo hi\nhi\npwd\n/home/alice\n", "", 0)
+
+	out, errs, code = runRCP(t, nil, ">>> 1+1\n2\n", "-strip-prompt", "-prompt-regex", `^>>> `)
+	checkRun(t, out, errs, code, "1+1\n2\n", "", 0)
+
+	out, errs, code = runRCP(t, nil, "x", "-strip-prompt", "-prompt-regex", "(")
+	checkRun(t, out, errs, code, "", "-prompt-regex", 2)
+}
+
+func TestClipWriter(t *testing.T) {
+	setGetenv(t, nil)
+	var term bytes.Buffer
+	w := &clipWriter{out: &term, sel: "p"}
+	w.buf.max = 100
+	if _, err := io.Copy(w, strings.NewReader("streamed\ncontent\n")); err != nil {
+		t.Fatal(err)
+	}
+	if term.Len() != 0 {
+		t.Fatalf("sent %q before Close", term.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ws := osc52Writes(t, term.String()); len(ws) != 1 || ws[0] != (osc52Write{"p", "streamed\ncontent\n"}) {
+		t.Errorf("sent %q", ws)
+	}
+	if err := w.Close(); err != nil || len(osc52Writes(t, term.String())) != 1 {
+		t.Errorf("second Close: %v, sent %q", err, term.String())
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+}
+
+func TestClipWriterLimit(t *testing.T) {
+	setGetenv(t, nil)
+	var term bytes.Buffer
+	w := &clipWriter{out: &term, sel: "c"}
+	w.buf.max = 10
+	_, err := io.Copy(w, iotest.OneByteReader(strings.NewReader(strings.Repeat("x", 25))))
+	tl, ok := asTooLarge(err)
+	if !ok || tl.max != 10 {
+		t.Fatalf("io.Copy error %v, want the too-large error", err)
+	}
+	if term.Len() != 0 {
+		t.Errorf("sent %q", term.String())
+	}
+	// The copy stops at the write that would cross the limit.
+	if w.buf.n != 10 {
+		t.Errorf("buffered %d bytes, want 10", w.buf.n)
+	}
+}
+
+func TestTildeHome(t *testing.T) {
+	const home = "/home/alice"
+	tests := []struct {
+		name, in string
+		envToo   bool
+		want     string
+	}{
+		{"under home", "/home/alice/src/app.go\n", false, "~/src/app.go\n"},
+		{"home itself", "cd /home/alice && ls", false, "cd ~ && ls"},
+		{"several", "/home/alice/a:/home/alice/b", false, "~/a:~/b"},
+		{"in quotes", `path = "/home/alice/x"`, false, `path = "~/x"`},
+		{"outside home", "/home/bob/x /etc/passwd", false, "/home/bob/x /etc/passwd"},
+		{"longer user name", "/home/alicex/y", false, "/home/alicex/y"},
+		{"nested deeper", "/data/home/alice/z", false, "/data/home/alice/z"},
+		{"env vars left alone", "$HOME/x ${HOME}/y", false, "$HOME/x ${HOME}/y"},
+		{"env vars too", "$HOME/x ${HOME}/y $HOMEDIR", true, "~/x ~/y $HOMEDIR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tildeHome([]byte(tt.in), home, tt.envToo)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := string(tildeHome([]byte("/home/alice/x"), "/home/alice/", false)); got != "~/x" {
+		t.Errorf("home with a trailing slash: got %q", got)
+	}
+}
+
+func TestRunTilde(t *testing.T) {
+	env := map[string]string{"HOME": "/home/alice"}
+	out, errs, code := runRCP(t, env, "/home/alice/notes $HOME /home/bob\n", "-tilde", "-tilde-env")
+	checkRun(t, out, errs, code, "~/notes ~ /home/bob\n", "", 0)
+
+	out, errs, code = runRCP(t, map[string]string{"HOME": ""}, "x", "-tilde")
+	checkRun(t, out, errs, code, "", "rcp: -tilde: $HOME is not defined", 1)
+}
+
+func TestRunExecStream(t *testing.T) {
+	const cmd = "echo a; sleep 0.4; echo b; sleep 0.4; echo c"
+	term := newFakeTerm(t, nil)
+	_, errs, code := runTerm(t, term, nil, "", "-e", cmd, "-e-stream", "-stream-interval", "100ms")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	var got []string
+	for _, w := range osc52Writes(t, term.String()) {
+		got = append(got, w.data)
+	}
+	// The clipboard follows the output as it arrives, and ends up with all of it.
+	want := []string{cmd + "\na\n", cmd + "\na\nb\n", cmd + "\na\nb\nc\n"}
+	if !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	_, errs, code = runTerm(t, newFakeTerm(t, nil), nil, "", "-e", "echo x; exit 3", "-e-stream", "-stream-interval", "50ms")
+	if code != 1 || !strings.Contains(errs, "exit status 3") {
+		t.Errorf("failing command: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunProfile(t *testing.T) {
+	cfg := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cfg, "rcp"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(cfg, "rcp"), "config", `# test profiles
+[tidy]
+-rtrim-lines -collapse-blank   # two at once
+-mask s3cret
+[interp]
+-interp -var who=profile
+[quiet]
+-q
+`)
+	env := map[string]string{"XDG_CONFIG_HOME": cfg}
+	const in = "a  \n\n\n\nb s3cret\n"
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"applies", []string{"-profile", "tidy"}, "a\n\nb ******\n"},
+		{"cli overrides", []string{"-profile", "tidy", "-collapse-blank=false"}, "a\n\n\n\nb ******\n"},
+		{"after a value", []string{"-mask", "b", "-profile", "tidy"}, "a\n\n* s3cret\n"},
+		{"list replaced", []string{"-profile=tidy", "-mask", "a"}, "*\n\nb s3cret\n"},
+		{"var replaced", []string{"-profile", "interp", "-var", "who=cli"}, "cli\n"},
+		{"var kept", []string{"-profile", "interp"}, "profile\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdin := in
+			if strings.HasPrefix(tt.name, "var") {
+				stdin = "${who}\n"
+			}
+			out, errs, code := runRCP(t, env, stdin, tt.args...)
+			checkRun(t, out, errs, code, tt.want, "", 0)
+		})
+	}
+
+	// A command-line flag that conflicts with a profile's wins over it, and
+	// -flag=false counts as not given.
+	for _, args := range [][]string{
+		{"-profile", "quiet", "-status"},
+		{"-profile", "quiet", "-q=false", "-status"},
+		{"-q=false", "-status"},
+	} {
+		out, errs, code := runRCP(t, env, "hi", args...)
+		checkRun(t, out, errs, code, "hi", "Sent 2 bytes", 0)
+	}
+	out, errs, code := runRCP(t, nil, "", "-c=false", "-e", "printf x")
+	checkRun(t, out, errs, code, "printf x\nx", "", 0)
+
+	for _, args := range [][]string{
+		{"-profile", "nosuch"},
+		{"-e", "echo hi", "-profile", "nosuch"},
+		{"-profile", "tidy", "-profile", "interp"},
+	} {
+		out, errs, code = runRCP(t, env, in, args...)
+		if code != 2 || out != "" || !strings.Contains(errs, "-profile") {
+			t.Errorf("%q: status %d, stdout %q, stderr %q", args, code, out, errs)
+		}
+	}
+}
+
+func TestNotifyCommand(t *testing.T) {
+	const title, body = "rcp", `Copied 5 bytes from it's "x"`
+	mac := notifyCommand("darwin", title, body)
+	if want := []string{"osascript", "-e", `display notification "Copied 5 bytes from it's \"x\"" with title "rcp"`}; !slices.Equal(mac, want) {
+		t.Errorf("darwin: %q, want %q", mac, want)
+	}
+	win := notifyCommand("windows", title, body)
+	if win[0] != "powershell" || !strings.Contains(win[len(win)-1], `CreateTextNode('Copied 5 bytes from it''s "x"')`) {
+		t.Errorf("windows: %q", win)
+	}
+	for _, goos := range []string{"linux", "freebsd"} {
+		if c := notifyCommand(goos, title, body); !slices.Equal(c, []string{"notify-send", "--app-name=rcp", title, body}) {
+			t.Errorf("%s: %q", goos, c)
+		}
+	}
+}
+
+func TestRunNotify(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("uses notify-send")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "args")
+	fakeBins(t, map[string]string{"notify-send": `printf '%s\n' "$@" > ` + log})
+	src := writeFile(t, dir, "notes.txt", "secret words\n")
+	out, errs, code := runRCP(t, nil, "", "-notify", src)
+	checkRun(t, out, errs, code, "secret words\n", "", 0)
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "--app-name=rcp\nrcp\nCopied 13 bytes from notes.txt\n"; got != want {
+		t.Errorf("notify-send got %q, want %q", got, want)
+	}
+
+	// No notifier is only a warning.
+	t.Setenv("PATH", t.TempDir())
+	out, errs, code = runRCP(t, nil, "hi", "-notify")
+	checkRun(t, out, errs, code, "hi", "notify-send not found", 0)
+}
+
+func TestJoinContinuations(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"docker run \\\n  -it \\\n  --rm \\\n  alpine sh\n", "docker run   -it   --rm   alpine sh\n"},
+		{"echo a\\\\\necho b\n", "echo a\\\\\necho b\n"},
+		{"echo a\\\\\\\nb\n", "echo a\\\\b\n"},
+		{"crlf \\\r\nnext\r\n", "crlf next\r\n"},
+		{"last \\", "last \\"},
+		{"no continuations\n", "no continuations\n"},
+	}
+	for _, tt := range tests {
+		if got := string(joinContinuations([]byte(tt.in))); got != tt.want {
+			t.Errorf("joinContinuations(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRunJoinContinuations(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "make \\\n  CC=clang \\\n  all\nls -d C:\\\\\n", "-join-continuations")
+	checkRun(t, out, errs, code, "make   CC=clang   all\nls -d C:\\\\\n", "", 0)
+}
+
+func TestRunMaxRuntime(t *testing.T) {
+	// idle has no writer, so opening it blocks; held has one that never
+	// closes, so reading it does.
+	dir := t.TempDir()
+	idle, held := filepath.Join(dir, "idle"), filepath.Join(dir, "held")
+	for _, p := range []string{idle, held} {
+		if err := syscall.Mkfifo(p, 0o600); err != nil {
+			t.Skipf("mkfifo: %v", err)
+		}
+	}
+	w, err := os.OpenFile(held, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fakeBins(t, map[string]string{"xclip": "exec sleep 10"})
+	t.Setenv("DISPLAY", ":0")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // so a client that gives up is noticed
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		args   []string
+		copied []string
+	}{
+		{"command", []string{"-e", "sleep 10 | cat"}, nil},
+		{"retries", []string{"-e", "false", "-retries", "5", "-retry-delay", "1s"}, nil},
+		{"stream", []string{"-e", "echo a; sleep 10", "-e-stream", "-stream-interval", "50ms"}, []string{"echo a; sleep 10\na\n"}},
+		{"filter", []string{"-e", "echo a", "-filter", "sleep 10"}, nil},
+		{"follow", []string{"-follow", "-quiet-interval", "50ms"}, []string{"early\n"}},
+		{"file without a writer", []string{idle}, nil},
+		{"file without data", []string{held}, nil},
+		{"inputs", []string{"-inputs", "a=" + held}, nil},
+		{"bridge", []string{"-bridge"}, nil},
+		{"paste service", []string{"-e", "echo a", "-paste-service", srv.URL}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// stdin never closes, so only the deadline can end the run.
+			pr, pw := io.Pipe()
+			t.Cleanup(func() { pw.Close() })
+			go pw.Write([]byte("early\n"))
+			var out, errb syncBuffer
+			start := time.Now()
+			code := run(append([]string{"-max-runtime", "300ms"}, tt.args...), pr, &out, &errb, nil, func(k string) string { return os.Getenv(k) })
+			if took := time.Since(start); took > 3*time.Second {
+				t.Errorf("took %s", took)
+			}
+			if code != exitMaxRuntime || !strings.Contains(errb.String(), "-max-runtime reached") {
+				t.Errorf("status %d, stderr %q", code, errb.String())
+			}
+			var got []string
+			for _, w := range osc52Writes(t, out.String()) {
+				got = append(got, w.data)
+			}
+			if !slices.Equal(got, tt.copied) {
+				t.Errorf("sent %q, want %q", got, tt.copied)
+			}
+		})
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	const in = `See https://example.com/docs?x=1#top, and (https://go.dev/doc/faq).
+Mirror: ftp://files.example.org:21/pub/ or https://example.com/docs?x=1#top again.
+Not URLs: example.com, http://, mailto:a@b.c, https://-bad.
+Wiki: https://en.wikipedia.org/wiki/Go_(programming_language)!
+"https://quoted.example/a"`
+	want := []string{
+		"https://example.com/docs?x=1#top",
+		"https://go.dev/doc/faq",
+		"ftp://files.example.org:21/pub/",
+		"https://en.wikipedia.org/wiki/Go_(programming_language)",
+		"https://quoted.example/a",
+	}
+	if got := string(extractURLs([]byte(in), true)); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("unique: got %q", got)
+	}
+	all := slices.Insert(slices.Clone(want), 3, want[0])
+	if got := string(extractURLs([]byte(in), false)); got != strings.Join(all, "\n")+"\n" {
+		t.Errorf("all: got %q", got)
+	}
+	if got := extractURLs([]byte("nothing here\n"), true); len(got) != 0 {
+		t.Errorf("no URLs: got %q", got)
+	}
+}
+
+func TestRunURLs(t *testing.T) {
+	const in = "GET https://a.example/x 200\nGET https://b.example/ 404\nGET https://a.example/x 200\n"
+	out, errs, code := runRCP(t, nil, in, "-urls")
+	checkRun(t, out, errs, code, "https://a.example/x\nhttps://b.example/\n", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-urls", "-urls-unique=false")
+	checkRun(t, out, errs, code, "https://a.example/x\nhttps://b.example/\nhttps://a.example/x\n", "", 0)
+}
+
+func TestGrepReader(t *testing.T) {
+	const in = "INFO start\nERROR disk\r\nWARN slow\nERROR net"
+	tests := []struct {
+		re     string
+		invert bool
+		want   string
+	}{
+		{"ERROR", false, "ERROR disk\r\nERROR net"},
+		{"ERROR", true, "INFO start\nWARN slow\n"},
+		{"^(WARN|INFO)", false, "INFO start\nWARN slow\n"},
+		{"disk$", false, "ERROR disk\r\n"},
+		{"nothing", false, ""},
+	}
+	for _, tt := range tests {
+		b, err := io.ReadAll(grepReader(strings.NewReader(in), regexp.MustCompile(tt.re), tt.invert))
+		if err != nil || string(b) != tt.want {
+			t.Errorf("grep %q (invert %v) = %q, %v; want %q", tt.re, tt.invert, b, err, tt.want)
+		}
+	}
+	_, err := io.ReadAll(grepReader(iotest.ErrReader(io.ErrUnexpectedEOF), regexp.MustCompile("x"), false))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("read error: got %v", err)
+	}
+}
+
+func TestRunGrep(t *testing.T) {
+	in := strings.Repeat("noise noise noise\n", 100) + "ERROR one\nERROR two\n"
+	limit := map[string]string{"RCOPY_MAX_BYTES": "100"}
+
+	out, errs, code := runRCP(t, limit, in, "-grep", "ERROR")
+	checkRun(t, out, errs, code, "ERROR one\nERROR two\n", "", 0)
+	out, errs, code = runRCP(t, nil, "a\nb\na\n", "-grep", "a", "-grep-v")
+	checkRun(t, out, errs, code, "b\n", "", 0)
+	// The limit applies to what the filter lets through.
+	out, errs, code = runRCP(t, limit, in, "-grep", "noise")
+	checkRun(t, out, errs, code, "", "exceeds limit 100", 1)
+
+	out, errs, code = runRCP(t, nil, in, "-plain", "-grep", "a")
+	checkRun(t, out, errs, code, "", "-grep can't be used with -plain", 2)
+}
+
+func TestRunCooldown(t *testing.T) {
+	env := map[string]string{"XDG_STATE_HOME": t.TempDir()}
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	step := func(d time.Duration, args ...string) (string, string, int) {
+		setNow(t, t0.Add(d))
+		return runRCP(t, env, "x", append([]string{"-cooldown", "10s"}, args...)...)
+	}
+
+	out, errs, code := step(0)
+	checkRun(t, out, errs, code, "x", "", 0)
+	out, errs, code = step(3 * time.Second)
+	checkRun(t, out, errs, code, "", "last copy was 3s ago (cooldown 10s)", 1)
+	// A refused copy doesn't restart the window.
+	out, errs, code = step(11 * time.Second)
+	checkRun(t, out, errs, code, "x", "", 0)
+	out, errs, code = step(12*time.Second, "-force")
+	checkRun(t, out, errs, code, "x", "", 0)
+	out, errs, code = step(20 * time.Second)
+	checkRun(t, out, errs, code, "", "last copy was 8s ago", 1)
+
+	b, err := os.ReadFile(filepath.Join(env["XDG_STATE_HOME"], "rcp", "last-copy"))
+	if want := strconv.FormatInt(t0.Add(12*time.Second).UnixNano(), 10) + "\n"; err != nil || string(b) != want {
+		t.Errorf("state file %q, %v; want just the time, %q", b, err, want)
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	const doc = `{"data": {"token": "abc!", "n": 3, "ok": true},
+ "items": [{"name": "first"}, {"name": "second", "tags": ["x", "y"]}]}`
+	tests := []struct{ path, want string }{
+		{".data.token", "abc!"},
+		{".data.n", "3"},
+		{".data.ok", "true"},
+		{".items.1.name", "second"},
+		{".items.1.tags.0", "x"},
+		{".items.0", `{"name": "first"}`},
+		{".", doc},
+	}
+	for _, tt := range tests {
+		got, err := jsonPath([]byte(doc), tt.path)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("jsonPath(%q) = %q, %v; want %q", tt.path, got, err, tt.want)
+		}
+	}
+
+	errTests := []struct{ data, path, want string }{
+		{doc, ".data.missing", `no key "missing" at .data`},
+		{doc, ".nope", `no key "nope" at the top level`},
+		{doc, ".items.2", "index 2 out of range at .items (length 2)"},
+		{doc, ".items.name", `.items is an array; "name" is not an index`},
+		{doc, ".data.n.x", `.data.n is not an object or array, so it has no "x"`},
+		{`{"a": `, ".a", "invalid JSON"},
+	}
+	for _, tt := range errTests {
+		if _, err := jsonPath([]byte(tt.data), tt.path); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("jsonPath(%q, %q) error %v, want %q", tt.data, tt.path, err, tt.want)
+		}
+	}
+}
+
+func TestRunJQ(t *testing.T) {
+	const in = `{"items": [{"name": "a"}, {"name": "b"}]}` + "\n"
+	out, errs, code := runRCP(t, nil, in, "-jq", ".items.1.name")
+	checkRun(t, out, errs, code, "b", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-jq", ".items.5")
+	checkRun(t, out, errs, code, "", "rcp: -jq .items.5: index 5 out of range", 1)
+	out, errs, code = runRCP(t, nil, "not json", "-jq", ".a")
+	checkRun(t, out, errs, code, "", "invalid JSON", 1)
+	out, errs, code = runRCP(t, nil, in, "-plain", "-jq", ".items")
+	checkRun(t, out, errs, code, "", "-jq can't be used with -plain", 2)
+}
+
+func TestMaskMatches(t *testing.T) {
+	re := regexp.MustCompile(`tok_[a-zé0-9]+`)
+	tests := []struct{ in, want string }{
+		{"id tok_1 end", "id ***** end"},
+		{"tok_abc", "*******"},
+		{"tok_abcd", "to****cd"},
+		{"key=tok_0123456789abcdef;", "key=to****************ef;"},
+		{"tok_éé99 and tok_x", "to****99 and *****"},
+		{"no secrets", "no secrets"},
+	}
+	for _, tt := range tests {
+		got := string(maskMatches([]byte(tt.in), re))
+		if got != tt.want {
+			t.Errorf("maskMatches(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if utf8.RuneCountInString(got) != utf8.RuneCountInString(tt.in) {
+			t.Errorf("maskMatches(%q) changed the length in runes", tt.in)
+		}
+	}
+}
+
+func TestRunMask(t *testing.T) {
+	const in = "user=alice password=hunter2hunter2 key=AKIAABCDEFGH\n"
+	out, errs, code := runRCP(t, nil, in, "-mask", `hunter2\w*`, "-mask", `AKIA[A-Z]+`)
+	checkRun(t, out, errs, code, "user=alice password=hu**********r2 key=AK********GH\n", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-mask", "(")
+	checkRun(t, out, errs, code, "", "-mask: error parsing regexp", 2)
+}
+
+func TestRunBothTmux(t *testing.T) {
+	dir := t.TempDir()
+	fakeBins(t, map[string]string{"tmux": `echo "$@" > ` + dir + `/args; cat > ` + dir + `/buffer`})
+	tmux := map[string]string{"TMUX": "/tmp/tmux-1000/default,1,0"}
+
+	out, errs, code := runRCP(t, tmux, "hello\n", "-both-tmux")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	seq := "\033]52;c;" + base64.StdEncoding.EncodeToString([]byte("hello\n")) + "\033\\"
+	if want := "\033Ptmux;" + strings.ReplaceAll(seq, "\033", "\033\033") + "\033\\"; out != want {
+		t.Errorf("stdout %q, want the passthrough %q", out, want)
+	}
+	for name, want := range map[string]string{"args": "load-buffer -\n", "buffer": "hello\n"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("tmux %s: %q, %v; want %q", name, b, err, want)
+		}
+	}
+
+	// Outside tmux only plain OSC52 goes out.
+	out, errs, code = runRCP(t, nil, "hi", "-both-tmux")
+	if code != 0 || out != "\033]52;c;aGk=\033\\" || !strings.Contains(errs, "not inside tmux") {
+		t.Errorf("outside tmux: status %d, stdout %q, stderr %q", code, out, errs)
+	}
+
+	fakeBins(t, map[string]string{"tmux": "echo 'no server running' >&2; exit 1"})
+	_, errs, code = runRCP(t, tmux, "hi", "-both-tmux")
+	if code != 1 || !strings.Contains(errs, "rcp: -both-tmux: tmux load-buffer: exit status 1: no server running") {
+		t.Errorf("tmux failing: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestCalc(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"10 - 4 - 3", "3"},
+		{"7 / 2", "3.5"},
+		{"8 / 2 / 2", "2"},
+		{"1 / 3", "0.3333333333333333"},
+		{"17 % 5", "2"},
+		{"-(2 + 3) * -2", "10"},
+		{"2.5 * 4", "10"},
+		{"123456789012345678901234567890 + 1", "123456789012345678901234567891"},
+	}
+	for _, tt := range tests {
+		if got, err := calc(tt.expr); err != nil || got != tt.want {
+			t.Errorf("calc(%q) = %q, %v; want %q", tt.expr, got, err, tt.want)
+		}
+	}
+
+	errTests := []struct{ expr, want string }{
+		{"1 / 0", "division by zero"},
+		{"5 % 0", "division by zero"},
+		{"7.5 % 2", "% needs whole numbers"},
+		{"(1 + 2", "invalid expression"},
+		{"2 ** 3", "at column 4: only numbers"},
+		{"1 << 3", "at column 1: only numbers"},
+		{"x + 1", "at column 1: only numbers"},
+		{`"a" + 1`, "only numbers"},
+		{"os.Exit(1)", "only numbers"},
+	}
+	for _, tt := range errTests {
+		if _, err := calc(tt.expr); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("calc(%q) error %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestRunCalc(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "", "-calc", "(2 + 4) / 4")
+	checkRun(t, out, errs, code, "1.5", "", 0)
+	out, errs, code = runRCP(t, nil, "", "-calc", "2 +")
+	checkRun(t, out, errs, code, "", "rcp: -calc: invalid expression", 1)
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	dir := t.TempDir()
+	fakeBins(t, map[string]string{"notify-send": `echo "$3" > ` + dir + `/body`})
+	out, errs, code = runRCP(t, nil, "", "-calc", "6 * 7", "-notify")
+	checkRun(t, out, errs, code, "42", "", 0)
+	if b, _ := os.ReadFile(filepath.Join(dir, "body")); string(b) != "Copied 2 bytes from -calc\n" {
+		t.Errorf("notification %q", b)
+	}
+}
+
+func TestStripQuotes(t *testing.T) {
+	tests := []struct {
+		in      string
+		perLine bool
+		want    string
+	}{
+		{`"s3cr3t"`, false, "s3cr3t"},
+		{"'value'\n", false, "value\n"},
+		{`""`, false, ""},
+		{`"nested 'one'"`, false, "nested 'one'"},
+		{`""twice""`, false, `"twice"`},
+		{"unquoted\n", false, "unquoted\n"},
+		{`"mismatched'`, false, `"mismatched'`},
+		{`"`, false, `"`},
+		{"\"multi\nline\"\r\n", false, "multi\nline\r\n"},
+		{"\"a\"\n'b'\r\nc\n\"d'\n", false, "\"a\"\n'b'\r\nc\n\"d'\n"},
+		{"\"a\"\n'b'\r\nc\n\"d'\n", true, "a\nb\r\nc\n\"d'\n"},
+	}
+	for _, tt := range tests {
+		if got := string(stripQuotes([]byte(tt.in), tt.perLine)); got != tt.want {
+			t.Errorf("stripQuotes(%q, %v) = %q, want %q", tt.in, tt.perLine, got, tt.want)
+		}
+	}
+}
+
+func TestRunStripQuotes(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "\"https://api.example.com\"\n", "-strip-quotes")
+	checkRun(t, out, errs, code, "https://api.example.com\n", "", 0)
+	out, errs, code = runRCP(t, nil, "'one'\n\"two\"\n", "-strip-quotes", "-per-line")
+	checkRun(t, out, errs, code, "one\ntwo\n", "", 0)
+}
+
+func TestRunSwapSelection(t *testing.T) {
+	term := newFakeTerm(t, map[string]string{"p": "selected text", "c": "old clipboard"})
+	_, errs, code := runTerm(t, term, nil, "", "-swap-selection", "p:c", "-status")
+	if code != 0 || errs != "Sent 13 bytes from selection p to selection c via OSC52\n" {
+		t.Fatalf("status %d, stderr %q", code, errs)
+	}
+	if c, p := term.selection("c"), term.selection("p"); c != "selected text" || p != "selected text" {
+		t.Errorf("clipboard %q, primary %q; want both %q", c, p, "selected text")
+	}
+	// Only the target is written, and only after reading the source.
+	ws := osc52Writes(t, term.String())
+	if want := []osc52Write{{"p", "?"}, {"c", "selected text"}}; !slices.Equal(ws, want) {
+		t.Errorf("writes %q, want %q", ws, want)
+	}
+
+	term = newFakeTerm(t, map[string]string{"c": "0123456789"})
+	_, errs, code = runTerm(t, term, map[string]string{"RCOPY_MAX_BYTES": "5"}, "", "-swap-selection", "c:s")
+	if code != 1 || !strings.Contains(errs, "10 bytes exceeds limit 5") || term.selection("s") != "" {
+		t.Errorf("too large: status %d, stderr %q", code, errs)
+	}
+
+	term = newFakeTerm(t, nil)
+	term.mute = true
+	_, errs, code = runTerm(t, term, nil, "", "-swap-selection", "p:c")
+	if code != 1 || !strings.Contains(errs, "can't read selection p") {
+		t.Errorf("mute terminal: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestRunProgress(t *testing.T) {
+	content := strings.Repeat("x", 100*1024)
+	src := writeFile(t, t.TempDir(), "big.txt", content)
+	env := map[string]string{"RCOPY_MAX_BYTES": "200000"}
+
+	term := newFakeTerm(t, nil)
+	_, errs, code := runTerm(t, term, env, "", "-progress", src)
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	shown := term.String()
+	if want := "\r[" + strings.Repeat("#", 30) + "] 100%  102400/102400 bytes\r\033[K"; !strings.Contains(shown, want) {
+		t.Errorf("terminal got %q, want the full bar then its erasure", shown[:min(len(shown), 200)])
+	}
+	if got := copied(t, shown); got != content {
+		t.Errorf("copied %d bytes, want %d", len(got), len(content))
+	}
+
+	// stdin has no known size, so there is no bar.
+	term = newFakeTerm(t, nil)
+	_, errs, code = runTerm(t, term, env, content, "-progress")
+	if code != 0 || strings.Contains(term.String(), "bytes\r") || strings.Contains(term.String(), "\033[K") {
+		t.Errorf("stdin: status %d, stderr %q, terminal drew a bar", code, errs)
+	}
+}
+
+// failAfter is a writer that takes n writes and fails the rest, keeping
+// every write it was given.
+type failAfter struct {
+	n   int
+	got []string
+}
+
+func (w *failAfter) Write(p []byte) (int, error) {
+	w.got = append(w.got, string(p))
+	if len(w.got) > w.n {
+		return 0, errors.New("link down")
+	}
+	return len(p), nil
+}
+
+func TestWriteKittyOSC52(t *testing.T) {
+	data := []byte("0123456789abcdefghij") // 28 base64 bytes
+	b64 := base64.StdEncoding.EncodeToString(data)
+	seq := func(s string) string { return "\033]52;c;" + s + "\033\\" }
+	clear := seq("!")
+
+	var out strings.Builder
+	n, err := writeKittyOSC52(&out, "c", data, 10, nil) // rounded down to 8
+	if err != nil || n != 5 {
+		t.Fatalf("wrote %d sequences, %v; want 5", n, err)
+	}
+	want := clear + seq(b64[:8]) + seq(b64[8:16]) + seq(b64[16:24]) + seq(b64[24:])
+	if out.String() != want {
+		t.Errorf("got %q,\nwant start, continue and end %q", out.String(), want)
+	}
+
+	// An interrupt before the end clears what was sent so far.
+	interrupt := make(chan os.Signal, 1)
+	interrupt <- os.Interrupt
+	out.Reset()
+	_, err = writeKittyOSC52(&out, "c", data, 8, interrupt)
+	if err == nil || out.String() != clear+clear {
+		t.Errorf("interrupted: got %q, %v; want two clears and an error", out.String(), err)
+	}
+
+	// So does a failed write, if the link lets the clear through.
+	w := &failAfter{n: 2}
+	_, err = writeKittyOSC52(w, "c", data, 8, nil)
+	if want := []string{clear, seq(b64[:8]), seq(b64[8:16]), clear}; err == nil || !slices.Equal(w.got, want) {
+		t.Errorf("failed write: got %q, %v; want %q", w.got, err, want)
+	}
+}
+
+func TestRunChunkResume(t *testing.T) {
+	content := strings.Repeat("k", 9000)
+	out, errs, code := runRCP(t, map[string]string{"TERM": "xterm-kitty"}, content, "-chunk-resume")
+	if code != 0 {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	ws := osc52Writes(t, out)
+	if len(ws) != 4 || ws[0].data != "!" {
+		t.Fatalf("got %d writes starting %q; want a clear then 3 chunks", len(ws), ws[0].data)
+	}
+	var joined string
+	for _, w := range ws[1:] {
+		joined += w.data
+	}
+	if joined != content {
+		t.Errorf("chunks join to %d bytes, want %d", len(joined), len(content))
+	}
+
+	out, errs, code = runRCP(t, map[string]string{"TERM": "xterm-256color"}, "hi", "-chunk-resume")
+	checkRun(t, out, errs, code, "hi", "xterm-256color has no framed chunks", 0)
+}
+
+func TestLocalClipboardCommands(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		bins      []string
+		paste, cp []string
+	}{
+		{"wayland", map[string]string{"WAYLAND_DISPLAY": "wayland-0", "DISPLAY": ":0"}, []string{"wl-paste", "wl-copy", "xclip"},
+			[]string{"wl-paste", "-n", "-p"}, []string{"wl-copy"}},
+		{"wayland without wl-clipboard", map[string]string{"WAYLAND_DISPLAY": "wayland-0", "DISPLAY": ":0"}, []string{"xclip"},
+			[]string{"xclip", "-o", "-selection", "primary"}, []string{"xclip", "-i", "-selection", "clipboard"}},
+		{"x11 xclip", map[string]string{"DISPLAY": ":0"}, []string{"xclip", "xsel", "wl-copy"},
+			[]string{"xclip", "-o", "-selection", "primary"}, []string{"xclip", "-i", "-selection", "clipboard"}},
+		{"x11 xsel", map[string]string{"DISPLAY": ":0"}, []string{"xsel"},
+			[]string{"xsel", "-o", "-p"}, []string{"xsel", "-i", "-b"}},
+		{"no display", nil, []string{"xclip", "wl-paste", "wl-copy"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bins := map[string]string{}
+			for _, b := range tt.bins {
+				bins[b] = "true"
+			}
+			fakeBins(t, bins)
+			t.Setenv("PATH", strings.Split(os.Getenv("PATH"), string(os.PathListSeparator))[0])
+			setGetenv(t, tt.env)
+			if got := localPasteCommand("primary"); !slices.Equal(got, tt.paste) {
+				t.Errorf("paste primary: %q, want %q", got, tt.paste)
+			}
+			if got := localCopyCommand("clipboard"); !slices.Equal(got, tt.cp) {
+				t.Errorf("copy clipboard: %q, want %q", got, tt.cp)
+			}
+		})
+	}
+}
+
+func TestRunPromote(t *testing.T) {
+	dir := t.TempDir()
+	fakeBins(t, map[string]string{
+		"wl-paste": `printf '%s\n' "$*" > ` + dir + `/paste-args; printf 'from primary'`,
+		"wl-copy":  `printf '%s\n' "$*" > ` + dir + `/copy-args; cat > ` + dir + `/clipboard`,
+	})
+	wayland := map[string]string{"WAYLAND_DISPLAY": "wayland-0"}
+	out, errs, code := runRCP(t, wayland, "", "-promote", "-status")
+	if code != 0 || out != "" || errs != "Copied 12 bytes from PRIMARY to CLIPBOARD\n" {
+		t.Fatalf("status %d, stdout %q, stderr %q", code, out, errs)
+	}
+	for name, want := range map[string]string{"paste-args": "-n -p\n", "copy-args": "\n", "clipboard": "from primary"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("%s: %q, %v; want %q", name, b, err, want)
+		}
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	out, errs, code = runRCP(t, wayland, "", "-promote")
+	checkRun(t, out, errs, code, "", "-promote: needs a local X11 or Wayland display", 1)
+}
+
+func TestRunStatusFormat(t *testing.T) {
+	setNow(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	const format = "{{.Mode}} {{.Bytes}} {{.Selection}} {{.Chunks}} {{printf \"%q\" .Wrap}} {{.Duration}}"
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", "aaa")
+
+	out, errs, code := runRCP(t, nil, "hello", "-status")
+	if code != 0 || copied(t, out) != "hello" || errs != "Sent 5 bytes via OSC52\n" {
+		t.Errorf("default: status %d, stderr %q", code, errs)
+	}
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		stdin string
+		args  []string
+		want  string
+	}{
+		{"file", nil, "", []string{a}, "file 3 c 1 \"\" 0s\n"},
+		{"tmux", map[string]string{"TMUX": "x"}, "hi", []string{"-both-tmux"}, "stdin 2 c 1 \"tmux\" 0s\n"},
+		{"map", nil, "", []string{"-map", a + ":p," + a + ":s"}, "map 3 p 1 \"\" 0s\nmap 3 s 1 \"\" 0s\n"},
+		{"follow", nil, "x\n", []string{"-follow"}, "stdin 2 c 1 \"\" 0s\n"},
+		{"e-stream", nil, "", []string{"-e", "echo y", "-e-stream"}, "exec 9 c 1 \"\" 0s\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env["TMUX"] != "" {
+				fakeBins(t, map[string]string{"tmux": "cat >/dev/null"})
+			}
+			_, errs, code := runRCP(t, tt.env, tt.stdin, append([]string{"-status", "-status-format", format}, tt.args...)...)
+			if code != 0 || errs != tt.want {
+				t.Errorf("status %d, stderr %q; want %q", code, errs, tt.want)
+			}
+		})
+	}
+
+	term := newFakeTerm(t, map[string]string{"p": "sel"})
+	_, errs, code = runTerm(t, term, nil, "", "-swap-selection", "p:c", "-status", "-status-format", format)
+	if code != 0 || errs != "swap 3 c 1 \"\" 0s\n" {
+		t.Errorf("swap: status %d, stderr %q", code, errs)
+	}
+
+	for _, args := range [][]string{{"-promote"}, {"-peek"}} {
+		out, errs, code := runRCP(t, nil, "", append(args, "-status-format", "{{.Bytes}}")...)
+		checkRun(t, out, errs, code, "", "-status-format can't be used with "+args[0], 2)
+	}
+	out, errs, code = runRCP(t, nil, "x", "-status-format", "{{.Nope")
+	checkRun(t, out, errs, code, "", "-status-format: template", 2)
+}
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGunzip(t *testing.T) {
+	text := strings.Repeat("log line\n", 50)
+	if got, err := gunzip([]byte(gzipped(t, text)), 1000); err != nil || string(got) != text {
+		t.Errorf("gzip: got %d bytes, %v; want %d", len(got), err, len(text))
+	}
+	if got, err := gunzip([]byte("plain text"), 1000); err != nil || string(got) != "plain text" {
+		t.Errorf("plain: got %q, %v", got, err)
+	}
+	if _, err := gunzip([]byte(gzipped(t, text)), len(text)-1); err == nil || !strings.Contains(err.Error(), "more than 449 bytes") {
+		t.Errorf("over the cap: %v", err)
+	}
+	if _, err := gunzip([]byte("\x1f\x8bnot really"), 1000); err == nil {
+		t.Error("bad gzip: no error")
+	}
+}
+
+func TestRunDecompress(t *testing.T) {
+	dir := t.TempDir()
+	gz := writeFile(t, dir, "app.log.gz", gzipped(t, "line one\nline two\n"))
+	out, errs, code := runRCP(t, nil, "", "-decompress", gz)
+	checkRun(t, out, errs, code, "line one\nline two\n", "", 0)
+	out, errs, code = runRCP(t, nil, "not compressed\n", "-decompress")
+	checkRun(t, out, errs, code, "not compressed\n", "", 0)
+
+	// The limit applies to the decompressed size.
+	big := writeFile(t, dir, "big.gz", gzipped(t, strings.Repeat("z", 5000)))
+	out, errs, code = runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "1000"}, "", "-decompress", big)
+	checkRun(t, out, errs, code, "", "decompresses to more than 1000 bytes", 1)
+
+	out, errs, code = runRCP(t, nil, "", "-plain", "-decompress", gz)
+	checkRun(t, out, errs, code, "", "-decompress can't be used with -plain", 2)
+}
+
+func TestRawCapForBase64(t *testing.T) {
+	for _, n := range []int{4, 5, 7, 8, 100, 65536, 99999} {
+		raw := rawCapForBase64(n)
+		if enc := base64.StdEncoding.EncodedLen(raw); enc > n {
+			t.Errorf("rawCapForBase64(%d) = %d encodes to %d bytes", n, raw, enc)
+		}
+		if enc := base64.StdEncoding.EncodedLen(raw + 1); enc <= n {
+			t.Errorf("rawCapForBase64(%d) = %d, but %d bytes fit too", n, raw, raw+1)
+		}
+	}
+}
+
+func TestRunMaxBase64Bytes(t *testing.T) {
+	// 16 encoded bytes hold 12 raw bytes.
+	out, errs, code := runRCP(t, nil, strings.Repeat("a", 12), "-max-base64-bytes", "16")
+	checkRun(t, out, errs, code, strings.Repeat("a", 12), "", 0)
+	if n := len(osc52Re.FindStringSubmatch(out)[2]); n != 16 {
+		t.Errorf("encoded %d bytes, want 16", n)
+	}
+
+	out, errs, code = runRCP(t, nil, strings.Repeat("a", 13), "-max-base64-bytes", "16")
+	checkRun(t, out, errs, code, "", "rcp: 13 bytes exceeds limit 12", 1)
+	if !strings.Contains(errs, "rcp -max-base64-bytes 20 <input>") || strings.Contains(errs, "RCOPY_MAX_BYTES=") {
+		t.Errorf("tip should name -max-base64-bytes: %q", errs)
+	}
+
+	// When RCOPY_MAX_BYTES is the smaller limit, the tip is the usual one.
+	out, errs, code = runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "10"}, strings.Repeat("a", 13), "-max-base64-bytes", "16")
+	checkRun(t, out, errs, code, "", "rcp: 13 bytes exceeds limit 10", 1)
+	if !strings.Contains(errs, "RCOPY_MAX_BYTES=1037 rcp <input>") {
+		t.Errorf("tip should name RCOPY_MAX_BYTES: %q", errs)
+	}
+
+	out, errs, code = runRCP(t, nil, "x", "-max-base64-bytes", "3")
+	checkRun(t, out, errs, code, "", "-max-base64-bytes must be at least 4", 2)
+}
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"host": "db.internal", "port": "5432", "empty": ""}
+	tests := []struct{ in, want string }{
+		{"psql -h ${host} -p ${port}", "psql -h db.internal -p 5432"},
+		{"${host}${port}${empty}!", "db.internal5432!"},
+		{"price: $$5, literal: $${host}", "price: $5, literal: ${host}"},
+		{"$$$$ and $ alone and $host", "$$ and $ alone and $host"},
+		{"unknown ${user} stays", "unknown ${user} stays"},
+		{"${not valid} ${1x}", "${not valid} ${1x}"},
+	}
+	for _, tt := range tests {
+		got, err := interpolate([]byte(tt.in), vars, false)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("interpolate(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	_, err := interpolate([]byte("${user}@${host} ${user} ${shell} $${quoted}"), vars, true)
+	if err == nil || err.Error() != "undefined: user, shell" {
+		t.Errorf("strict: error %v, want the unknown names once each", err)
+	}
+}
+
+func TestRunInterp(t *testing.T) {
+	const in = "ssh ${user}@${host} # costs $$0\n"
+	out, errs, code := runRCP(t, nil, in, "-interp", "-var", "user=deploy", "-var", "host=a=b")
+	checkRun(t, out, errs, code, "ssh deploy@a=b # costs $0\n", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-interp", "-var", "user=deploy")
+	checkRun(t, out, errs, code, "ssh deploy@${host} # costs $0\n", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-interp", "-interp-strict", "-var", "user=deploy")
+	checkRun(t, out, errs, code, "", "rcp: -interp: undefined: host. Refusing.", 1)
+	out, errs, code = runRCP(t, nil, in, "-interp", "-var", "bad name=x")
+	checkRun(t, out, errs, code, "", `-var: bad definition "bad name=x"`, 2)
+}
+
+func TestRunProgressQuiet(t *testing.T) {
+	src := writeFile(t, t.TempDir(), "big.txt", strings.Repeat("x", 50000))
+	term := newFakeTerm(t, nil)
+	_, errs, code := runTerm(t, term, nil, "", "-progress", "-q", src)
+	if code != 0 || errs != "" || strings.Contains(term.String(), "bytes\r") || strings.Contains(term.String(), "\033[K") {
+		t.Errorf("status %d, stderr %q; the bar was drawn despite -q", code, errs)
+	}
+}
+
+func TestUnwrapLines(t *testing.T) {
+	const trace = "ERROR boom\n  at main.go:10\n\tat lib.go:3\nINFO next\n"
+	tests := []struct {
+		in    string
+		space bool
+		want  string
+	}{
+		{trace, false, "ERROR boom  at main.go:10\tat lib.go:3\nINFO next\n"},
+		{trace, true, "ERROR boom at main.go:10 at lib.go:3\nINFO next\n"},
+		{"a\r\n  b\r\nc", true, "a b\r\nc"},
+		{"  leading\nx\n", true, "  leading\nx\n"},
+		{"a\n\n  after blank\n", true, "a\n\n  after blank\n"},
+		{"a\n   \n  b\n", true, "a\n   \n  b\n"},
+		{"a\n  b", false, "a  b"},
+	}
+	for _, tt := range tests {
+		if got := string(unwrapLines([]byte(tt.in), tt.space)); got != tt.want {
+			t.Errorf("unwrapLines(%q, %v) = %q, want %q", tt.in, tt.space, got, tt.want)
+		}
+	}
+}
+
+func TestRunUnwrap(t *testing.T) {
+	const in = "WARN retry\n    attempt 2\nWARN retry\n    attempt 3\n"
+	out, errs, code := runRCP(t, nil, in, "-unwrap")
+	checkRun(t, out, errs, code, "WARN retry    attempt 2\nWARN retry    attempt 3\n", "", 0)
+	out, errs, code = runRCP(t, nil, in, "-unwrap", "-unwrap-space")
+	checkRun(t, out, errs, code, "WARN retry attempt 2\nWARN retry attempt 3\n", "", 0)
+}
+
+func TestPeekText(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"0123456789abc", 10, "0123456789\n... (3 more bytes)"},
+		{"ééééé", 5, "éé\n... (6 more bytes)"}, // no half characters
+		{"", 10, ""},
+	}
+	for _, tt := range tests {
+		if got := peekText([]byte(tt.in), tt.max); got != tt.want {
+			t.Errorf("peekText(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestRunPeek(t *testing.T) {
+	term := newFakeTerm(t, map[string]string{"c": "on the clipboard"})
+	_, errs, code := runTerm(t, term, nil, "", "-peek")
+	if code != 0 || errs != "Clipboard holds 16 bytes:\non the clipboard\n" {
+		t.Errorf("status %d, stderr %q", code, errs)
+	}
+	// Read-only: the only OSC52 sent is the read request.
+	if ws := osc52Writes(t, term.String()); !slices.Equal(ws, []osc52Write{{"c", "?"}}) || term.selection("c") != "on the clipboard" {
+		t.Errorf("writes %q", ws)
+	}
+
+	long := strings.Repeat("L", peekMaxBytes+500)
+	_, errs, code = runTerm(t, newFakeTerm(t, map[string]string{"c": long}), nil, "", "-peek")
+	if want := fmt.Sprintf("Clipboard holds %d bytes:\n%s\n... (500 more bytes)\n", len(long), long[:peekMaxBytes]); code != 0 || errs != want {
+		t.Errorf("long: status %d, stderr %d bytes", code, len(errs))
+	}
+
+	term = newFakeTerm(t, nil)
+	term.mute = true
+	_, errs, code = runTerm(t, term, nil, "", "-peek")
+	if code != 1 || !strings.Contains(errs, "rcp: -peek: can't read the clipboard") {
+		t.Errorf("mute: status %d, stderr %q", code, errs)
+	}
+}
+
+func TestConvertBase(t *testing.T) {
+	tests := []struct {
+		in       string
+		from, to int
+		want     string
+	}{
+		{"ff", 16, 10, "255"},
+		{"0xFF\n", 16, 10, "255"},
+		{"  0Xdead_beef", 16, 10, ""},
+		{"10", 10, 2, "1010"},
+		{"-10", 10, 2, "-1010"},
+		{"+7", 10, 8, "7"},
+		{"0b1010", 2, 16, "a"},
+		{"0o777", 8, 10, "511"},
+		{"0", 16, 2, "0"},
+		{"18446744073709551616", 10, 16, "10000000000000000"},
+	}
+	for _, tt := range tests {
+		got, err := convertBase([]byte(tt.in), tt.from, tt.to)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("convertBase(%q, %d, %d) = %q, want an error", tt.in, tt.from, tt.to, got)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("convertBase(%q, %d, %d) = %q, %v; want %q", tt.in, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "12z", "0x", "--1", "+-1", "2", "1.5", "0x10"} {
+		if got, err := convertBase([]byte(in), 2, 10); err == nil {
+			t.Errorf("convertBase(%q, 2, 10) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestParseBases(t *testing.T) {
+	if from, to, ok := parseBases("16:10"); !ok || from != 16 || to != 10 {
+		t.Errorf("16:10: %d %d %v", from, to, ok)
+	}
+	for _, s := range []string{"16", "16:3", "x:10", ":", "16:10:2"} {
+		if _, _, ok := parseBases(s); ok {
+			t.Errorf("parseBases(%q) accepted", s)
+		}
+	}
+}
+
+func TestRunBase(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "0x1F\n", "-base", "16:10")
+	checkRun(t, out, errs, code, "31", "", 0)
+	out, errs, code = runRCP(t, nil, "5", "-base", "10:2")
+	checkRun(t, out, errs, code, "101", "", 0)
+	out, errs, code = runRCP(t, nil, "hello", "-base", "10:16")
+	checkRun(t, out, errs, code, "", `rcp: -base 10:16: "hello" is not a base-10 number. Refusing.`, 1)
+	out, errs, code = runRCP(t, nil, "5", "-base", "10:3")
+	checkRun(t, out, errs, code, "", `-base: bad value "10:3"`, 2)
+	out, errs, code = runRCP(t, nil, "5", "-plain", "-base", "10:2")
+	checkRun(t, out, errs, code, "", "-base can't be used with -plain", 2)
+}
+
+func TestRunOnEmpty(t *testing.T) {
+	tests := []struct {
+		policy string
+		out    string
+		errs   string
+		code   int
+	}{
+		{"", "", "rcp: nothing to copy from <input>; leaving the clipboard alone", 1},
+		{"refuse", "", "rcp: nothing to copy from <input>", 1},
+		{"clear", "\033]52;c;!\033\\", "Cleared clipboard\n", 0},
+		{"allow", "\033]52;c;\033\\", "Sent 0 bytes via OSC52\n", 0},
+	}
+	for _, tt := range tests {
+		args := []string{"-status"}
+		if tt.policy != "" {
+			args = append(args, "-on-empty", tt.policy)
+		}
+		out, errs, code := runRCP(t, nil, "", args...)
+		if code != tt.code || out != tt.out || !strings.HasPrefix(errs, tt.errs) {
+			t.Errorf("-on-empty %q: status %d, stdout %q, stderr %q", tt.policy, code, out, errs)
+		}
+	}
+
+	// Empty is judged after transforms.
+	out, errs, code := runRCP(t, nil, "no links here\n", "-urls")
+	checkRun(t, out, errs, code, "", "nothing to copy", 1)
+	out, errs, code = runRCP(t, nil, "", "-on-empty", "wipe")
+	checkRun(t, out, errs, code, "", `-on-empty: unknown value "wipe" (refuse, clear, allow)`, 2)
+}
+
+func TestTidy(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{
+			"    func f() {   \n        return 1\t\n\n\n\n    }\n\n\n",
+			"func f() {\n    return 1\n\n}\n",
+		},
+		{"\tif x {\r\n\t\ty()  \r\n\t}", "if x {\r\n\ty()\r\n}\r\n"},
+		{"  a\n\tb\n", "  a\n\tb\n"}, // no shared indentation
+		{"one line", "one line\n"},
+		{" \n\t\n\n", ""},
+	}
+	for _, tt := range tests {
+		if got := string(tidy([]byte(tt.in))); got != tt.want {
+			t.Errorf("tidy(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRunTidy(t *testing.T) {
+	const messy = "\n    def f(x):   \n        if x:\n\n\n            return 1\n        return 0  \n\n"
+	out, errs, code := runRCP(t, nil, messy, "-tidy")
+	checkRun(t, out, errs, code, "\ndef f(x):\n    if x:\n\n        return 1\n    return 0\n", "", 0)
+	out, errs, code = runRCP(t, nil, messy, "-tidy", "-plain")
+	checkRun(t, out, errs, code, messy, "", 0)
+}
+
+func TestRunFilter(t *testing.T) {
+	out, errs, code := runRCP(t, nil, "foo bar foo\n", "-filter", "sed s/foo/baz/g")
+	checkRun(t, out, errs, code, "baz bar baz\n", "", 0)
+	// The filter sees the content after transforms.
+	out, errs, code = runRCP(t, nil, "b  \na\n", "-rtrim-lines", "-filter", "sort | cat -A")
+	checkRun(t, out, errs, code, "a$\nb$\n", "", 0)
+
+	out, errs, code = runRCP(t, nil, "x\n", "-filter", "echo oops >&2; exit 4")
+	checkRun(t, out, errs, code, "", "rcp: -filter \"echo oops >&2; exit 4\" failed (exit status 4); nothing copied", 1)
+	if !strings.HasPrefix(errs, "oops\n") {
+		t.Errorf("the filter's stderr should pass through: %q", errs)
+	}
+
+	// Output past the limit stops the filter instead of leaving it running.
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	out, errs, code = runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "1000"}, "x\n", "-filter", "echo $$ > "+pidFile+"; exec yes")
+	checkRun(t, out, errs, code, "", "exceeds limit 1000", 1)
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("filter %d still running after rcp returned (kill: %v)", pid, err)
+	}
+}
+
+func TestRunExecStreamHost(t *testing.T) {
+	header := hostHeader(false)
+	const cmd = "echo one; sleep 0.3; echo two; sleep 0.3; echo three"
+	// Room for the header, the command line and one short line of output.
+	env := map[string]string{"RCOPY_MAX_BYTES": strconv.Itoa(len(header) + len(cmd) + 1 + 8)}
+	term := newFakeTerm(t, nil)
+	_, errs, code := runTerm(t, term, env, "", "-e", cmd, "-e-stream", "-host", "-stream-interval", "100ms")
+	if code != 0 || errs != "" {
+		t.Fatalf("status %d: %s", code, errs)
+	}
+	var got []string
+	for _, w := range osc52Writes(t, term.String()) {
+		got = append(got, w.data)
+	}
+	pre := header + cmd + "\n"
+	if want := []string{pre + "one\n", pre + "one\ntwo\n", pre + "three\n"}; !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	out, errs, code := runRCP(t, map[string]string{"RCOPY_MAX_BYTES": "5"}, "", "-e", "echo x", "-e-stream", "-host")
+	checkRun(t, out, errs, code, "", "the -host header alone exceeds limit 5", 1)
+}